@@ -2,105 +2,113 @@ package gocelery
 
 import (
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/streadway/amqp"
 )
 
 // AMQPCeleryBackend CeleryBackend for AMQP
+// It reconnects when its connection is lost, see BackendConnectionTimeout.
 type AMQPCeleryBackend struct {
-	*amqp.Channel
-	connection *amqp.Connection
-	exchange   *AMQPExchange
-	host       string
+	session *amqpSession
+	host    string
+	options backendOptions
+	lock    sync.Mutex
+	// states are the latest unfinished states of tasks, their messages are already consumed
+	states map[string]*ResultMessage
 }
 
 // NewAMQPCeleryBackend creates new AMQPCeleryBackend
-func NewAMQPCeleryBackend(host string) *AMQPCeleryBackend {
-	conn, channel := NewAMQPConnection(host)
-	// ensure exchange is initialized
-	backend := &AMQPCeleryBackend{
-		Channel:    channel,
-		connection: conn,
-		host:       host,
+func NewAMQPCeleryBackend(host string, options ...BackendOptions) (*AMQPCeleryBackend, error) {
+	do := newBackendOptions(options)
+	session, err := newAMQPSession(host, do.ConnectionTimeout, nil)
+	if err != nil {
+		return nil, err
 	}
-	return backend
+	return &AMQPCeleryBackend{
+		session: session,
+		host:    host,
+		options: do,
+		states:  make(map[string]*ResultMessage),
+	}, nil
 }
 
 // Reconnect reconnects to AMQP server
 func (b *AMQPCeleryBackend) Reconnect() {
-	b.connection.Close()
-	conn, channel := NewAMQPConnection(b.host)
-	b.Channel = channel
-	b.connection = conn
+	if channel, err := b.session.get(0); err == nil {
+		b.session.reset(channel, nil)
+	}
+}
+
+// Close closes connection to AMQP server
+func (b *AMQPCeleryBackend) Close() error {
+	return b.session.Close()
 }
 
 // GetResult retrieves result from AMQP queue
+// It does not block: messages of the task queue are fetched until it is empty and the latest
+// state is returned, or ErrResultNotAvailable if there is none. Unfinished states are kept until
+// they are replaced, final results are returned once. It is safe for concurrent use,
+// each call uses its own channel.
 func (b *AMQPCeleryBackend) GetResult(taskID string) (*ResultMessage, error) {
 
 	queueName := strings.Replace(taskID, "-", "", -1)
 
 	args := amqp.Table{"x-expires": int32(86400000)}
 
-	_, err := b.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		true,      // autoDelete
-		false,     // exclusive
-		false,     // noWait
-		args,      // args
-	)
-	if err != nil {
+	var deliveries []amqp.Delivery
+	err := b.session.doPooled(func(channel *amqp.Channel) error {
+		// declare queue, as getting from missing queue closes the channel
+		_, err := channel.QueueDeclare(
+			queueName, // name
+			true,      // durable
+			true,      // autoDelete
+			false,     // exclusive
+			false,     // noWait
+			args,      // args
+		)
+		if err != nil {
+			return err
+		}
+		for {
+			delivery, ok, err := channel.Get(queueName, true)
+			if err != nil || !ok {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+	})
+	if err != nil && len(deliveries) == 0 {
 		return nil, err
 	}
+	return b.updateState(taskID, deliveries)
+}
 
-	err = b.ExchangeDeclare(
-		"default",
-		"direct",
-		true,
-		true,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return nil, err
+// updateState returns the latest state of task from its fetched result messages
+func (b *AMQPCeleryBackend) updateState(taskID string, deliveries []amqp.Delivery) (*ResultMessage, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	result := b.states[taskID]
+	for _, delivery := range deliveries {
+		encryption, _ := delivery.Headers["encryption"].(string)
+		received, err := b.options.decodeResult(delivery.Body, delivery.ContentType, encryption)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil || !isReadyState(result.Status) {
+			result = received
+		}
 	}
-
-	// Hack to avoid Exception (503) Reason: "unexpected command received"
-	// https://github.com/streadway/amqp/issues/170
-	// AMQP does not allow concurrent use of channels!
-	// Fixed by implementing periodic polling
-	// https://github.com/shicky/gocelery/issues/18
-	// time.Sleep(50 * time.Millisecond)
-
-	// open channel temporarily
-	channel, err := b.Consume(queueName, "", false, false, false, false, nil)
-	if err != nil {
-		return nil, err
+	if result == nil {
+		return nil, ErrResultNotAvailable
 	}
-
-	var resultMessage ResultMessage
-
-	delivery := <-channel
-	delivery.Ack(false)
-	if err := json.Unmarshal(delivery.Body, &resultMessage); err != nil {
-		return nil, err
+	if isReadyState(result.Status) {
+		delete(b.states, taskID)
+	} else {
+		b.states[taskID] = result
 	}
-	return &resultMessage, nil
-
-	/*
-		select {
-		case delivery := <-channel:
-			delivery.Ack(false)
-			if err := json.Unmarshal(delivery.Body, &resultMessage); err != nil {
-				return nil, err
-			}
-			return &resultMessage, nil
-		default:
-			return nil, fmt.Errorf("failed to read from channel")
-		}
-	*/
+	return result, nil
 }
 
 // SetResult sets result back to AMQP queue
@@ -111,51 +119,60 @@ func (b *AMQPCeleryBackend) SetResult(taskID string, result *ResultMessage) erro
 	// queueName := taskID
 	queueName := strings.Replace(taskID, "-", "", -1)
 
-	// autodelete is automatically set to true by python
-	// (406) PRECONDITION_FAILED - inequivalent arg 'durable' for queue 'bc58c0d895c7421eb7cb2b9bbbd8b36f' in vhost '/': received 'true' but current is 'false'
-
-	args := amqp.Table{"x-expires": int32(86400000)}
-	_, err := b.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		true,      // autoDelete
-		false,     // exclusive
-		false,     // noWait
-		args,      // args
-	)
-	if err != nil {
-		return err
-	}
-
-	err = b.ExchangeDeclare(
-		"default",
-		"direct",
-		true,
-		true,
-		false,
-		false,
-		nil,
-	)
+	serializer, resBytes, err := b.options.encodeResult(result)
 	if err != nil {
 		return err
 	}
 
-	resBytes, err := json.Marshal(result)
-	if err != nil {
-		return err
+	var headers amqp.Table
+	if b.options.Encryption != "" {
+		headers = amqp.Table{"encryption": b.options.Encryption}
 	}
-
 	message := amqp.Publishing{
-		DeliveryMode: amqp.Persistent,
-		Timestamp:    time.Now(),
-		ContentType:  "application/json",
-		Body:         resBytes,
+		Headers:         headers,
+		DeliveryMode:    amqp.Persistent,
+		Timestamp:       time.Now(),
+		ContentType:     serializer.ContentType(),
+		ContentEncoding: serializer.ContentEncoding(),
+		Body:            resBytes,
 	}
-	return b.Publish(
-		"",
-		queueName,
-		false,
-		false,
-		message,
-	)
+
+	return b.session.doPooled(func(channel *amqp.Channel) error {
+		// autodelete is automatically set to true by python
+		// (406) PRECONDITION_FAILED - inequivalent arg 'durable' for queue 'bc58c0d895c7421eb7cb2b9bbbd8b36f' in vhost '/': received 'true' but current is 'false'
+
+		args := amqp.Table{"x-expires": int32(86400000)}
+		_, err := channel.QueueDeclare(
+			queueName, // name
+			true,      // durable
+			true,      // autoDelete
+			false,     // exclusive
+			false,     // noWait
+			args,      // args
+		)
+		if err != nil {
+			return err
+		}
+
+		err = channel.ExchangeDeclare(
+			"default",
+			"direct",
+			true,
+			true,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+
+		return channel.Publish(
+			"",
+			queueName,
+			false,
+			false,
+			message,
+		)
+	})
 }
@@ -1,7 +1,13 @@
 package gocelery
 
 import (
+	"encoding/base64"
+	"fmt"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/streadway/amqp"
@@ -10,7 +16,7 @@ import (
 // AMQPExchange stores AMQP Exchange configuration
 type AMQPExchange struct {
 	Name       string
-	Type       string
+	Type       string // direct, topic or fanout
 	Durable    bool
 	AutoDelete bool
 }
@@ -30,6 +36,24 @@ type AMQPQueue struct {
 	Name       string
 	Durable    bool
 	AutoDelete bool
+	// Exchange and RoutingKey bind the queue, to the broker exchange with queue name by default
+	// Routing key of topic exchanges may have wildcards, fanout exchanges ignore it.
+	Exchange   *AMQPExchange
+	RoutingKey string
+	// Arguments of the queue, fields below override them
+	Arguments amqp.Table
+	// MaxPriority enables priorities of messages up to it, x-max-priority
+	MaxPriority int
+	// MessageTTL discards messages staying in the queue longer, x-message-ttl
+	MessageTTL time.Duration
+	// DeadLetterExchange receives rejected and expired messages, with DeadLetterRoutingKey
+	// instead of their routing key when set, x-dead-letter-exchange and x-dead-letter-routing-key
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+	// Type is classic or quorum, x-queue-type; quorum queues must be durable and not auto-deleted
+	Type string
+	// Lazy keeps messages on disk rather than in memory, x-queue-mode of classic queues
+	Lazy bool
 }
 
 // NewAMQPQueue creates new AMQPQueue
@@ -41,149 +65,764 @@ func NewAMQPQueue(name string) *AMQPQueue {
 	}
 }
 
+// arguments returns arguments the queue is declared with
+func (q *AMQPQueue) arguments() (amqp.Table, error) {
+	args := make(amqp.Table, len(q.Arguments))
+	for k, v := range q.Arguments {
+		args[k] = v
+	}
+	if q.MaxPriority < 0 || q.MaxPriority > 255 {
+		return nil, fmt.Errorf("max priority %d of queue %s is out of range 0-255", q.MaxPriority, q.Name)
+	}
+	if q.MaxPriority > 0 {
+		args["x-max-priority"] = int32(q.MaxPriority)
+	}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(q.MessageTTL / time.Millisecond)
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if q.Type != "" {
+		args["x-queue-type"] = q.Type
+	}
+	if q.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+	if args["x-queue-type"] == "quorum" {
+		if !q.Durable || q.AutoDelete {
+			return nil, fmt.Errorf("quorum queue %s must be durable and not auto-deleted", q.Name)
+		}
+		if args["x-queue-mode"] != nil {
+			return nil, fmt.Errorf("quorum queue %s cannot be lazy", q.Name)
+		}
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return args, args.Validate()
+}
+
+// amqpGetTaskTimeout is how long GetTask waits for task
+const amqpGetTaskTimeout = time.Second
+
 // AMQPCeleryBroker is RedisBroker for AMQP
+// It reconnects when its connection is lost, declaring exchanges and queues again
+// and resuming consumption, see BrokerConnectionTimeout.
+// Queues are consumed once tasks are requested, each by a consumer of its own,
+// see BrokerConsumeQueues, AddConsumer and CancelConsumer.
 type AMQPCeleryBroker struct {
-	*amqp.Channel
-	connection       *amqp.Connection
-	exchange         *AMQPExchange
-	queue            *AMQPQueue
-	consumingChannel <-chan amqp.Delivery
-	rate             int
+	session     *amqpSession
+	exchange    *AMQPExchange
+	queue       *AMQPQueue
+	queues      map[string]*AMQPQueue
+	exchanges   map[string]*AMQPExchange
+	multiplier  int
+	concurrency int
+	held        int // tasks held by the worker until their ETA, added to prefetch window
+	acksLate    bool
+	confirm     bool
+	mandatory   bool
+	lock        sync.Mutex
+	// consumers are consumed queues by name, consuming is set once tasks are requested
+	consumers map[string]amqpConsumer
+	consuming bool
+	// deliveries receives deliveries of all consumers
+	deliveries chan amqp.Delivery
+	// declared are routes whose exchange and queue were declared on current connection
+	declared map[CeleryDeliveryInfo]bool
+	// confirms track publishing on confirmsChannel, with publisher confirms or mandatory flag
+	confirms        *amqpConfirms
+	confirmsChannel *amqp.Channel
+}
+
+// amqpConsumer is consumer of queue on channel, channel is nil until it is consumed
+type amqpConsumer struct {
+	channel *amqp.Channel
+	tag     string
 }
 
 // NewAMQPConnection creates new AMQP channel
-func NewAMQPConnection(host string) (*amqp.Connection, *amqp.Channel) {
+func NewAMQPConnection(host string) (*amqp.Connection, *amqp.Channel, error) {
 	connection, err := amqp.Dial(host)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	// defer connection.Close()
 	channel, err := connection.Channel()
 	if err != nil {
-		panic(err)
+		connection.Close()
+		return nil, nil, err
 	}
-	return connection, channel
+	return connection, channel, nil
 }
 
 // NewAMQPCeleryBroker creates new AMQPCeleryBroker
-func NewAMQPCeleryBroker(host string) *AMQPCeleryBroker {
-	conn, channel := NewAMQPConnection(host)
-	// ensure exchange is initialized
+// Tasks are consumed from queue named by BrokerQueueName, celery by default, which is bound
+// to exchange set by BrokerExchange, default by default. Queues set by BrokerQueues are declared
+// with their bindings, BrokerConsumeQueues sets queues consumed instead.
+func NewAMQPCeleryBroker(host string, options ...BrokerOptions) (*AMQPCeleryBroker, error) {
+	do := newBrokerOptions(options)
+	if do.Exchange == nil {
+		do.Exchange = NewAMQPExchange("default")
+	}
 	broker := &AMQPCeleryBroker{
-		Channel:    channel,
-		connection: conn,
-		exchange:   NewAMQPExchange("default"),
-		queue:      NewAMQPQueue("celery"),
-		rate:       4,
+		exchange:    do.Exchange,
+		queues:      make(map[string]*AMQPQueue),
+		exchanges:   map[string]*AMQPExchange{do.Exchange.Name: do.Exchange},
+		multiplier:  do.PrefetchMultiplier,
+		concurrency: 1,
+		acksLate:    do.AcksLate,
+		confirm:     do.Confirms,
+		mandatory:   do.Mandatory,
+		consumers:   make(map[string]amqpConsumer),
+		deliveries:  make(chan amqp.Delivery),
+	}
+	for _, queue := range do.Queues {
+		broker.queues[queue.Name] = queue
+		if queue.Exchange != nil {
+			broker.exchanges[queue.Exchange.Name] = queue.Exchange
+		}
+	}
+	broker.queue = broker.queues[do.QueueName]
+	if broker.queue == nil {
+		broker.queue = NewAMQPQueue(do.QueueName)
+		broker.queues[do.QueueName] = broker.queue
+	}
+	consumed := do.ConsumeQueues
+	if len(consumed) == 0 {
+		consumed = []string{do.QueueName}
+	}
+	for _, name := range consumed {
+		broker.consumers[name] = amqpConsumer{}
 	}
-	if err := broker.CreateExchange(); err != nil {
-		panic(err)
+	session, err := newAMQPSession(host, do.ConnectionTimeout, broker.setup)
+	if err != nil {
+		return nil, err
+	}
+	broker.session = session
+	return broker, nil
+}
+
+// setup declares exchanges and queues and resumes consuming on new channel
+func (b *AMQPCeleryBroker) setup(channel *amqp.Channel) error {
+	b.lock.Lock()
+	b.declared = make(map[CeleryDeliveryInfo]bool)
+	b.lock.Unlock()
+	if err := b.declareExchange(channel, b.exchange); err != nil {
+		return err
 	}
-	if err := broker.CreateQueue(); err != nil {
-		panic(err)
+	for _, queue := range b.queues {
+		if err := b.declareQueue(channel, queue); err != nil {
+			return err
+		}
 	}
-	if err := broker.Qos(broker.rate, 0, false); err != nil {
-		panic(err)
+	if b.confirm || b.mandatory {
+		confirms, err := newAMQPConfirms(channel, b.confirm)
+		if err != nil {
+			return err
+		}
+		b.lock.Lock()
+		b.confirms, b.confirmsChannel = confirms, channel
+		b.lock.Unlock()
 	}
-	if err := broker.StartConsumingChannel(); err != nil {
-		panic(err)
+	b.lock.Lock()
+	consuming := b.consuming
+	b.lock.Unlock()
+	if !consuming {
+		return nil
 	}
-	return broker
+	return b.consumeAll(channel)
 }
 
-// StartConsumingChannel spawns receiving channel on AMQP queue
+// StartConsumingChannel starts consuming queues, GetTask does it when it is called first
 func (b *AMQPCeleryBroker) StartConsumingChannel() error {
-	channel, err := b.Consume(b.queue.Name, "", false, false, false, false, nil)
+	b.lock.Lock()
+	if b.consuming {
+		b.lock.Unlock()
+		return nil
+	}
+	b.consuming = true
+	b.lock.Unlock()
+	return b.session.do(b.consumeAll)
+}
+
+// SetConcurrency sets number of tasks processed at once, the worker sets it to number of its goroutines
+// Consumers prefetch concurrency times BrokerPrefetchMultiplier tasks in total.
+func (b *AMQPCeleryBroker) SetConcurrency(concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	b.lock.Lock()
+	b.concurrency = concurrency
+	b.lock.Unlock()
+	return b.session.do(b.qos)
+}
+
+// HoldTasks widens prefetch window by number of tasks held by the worker until their ETA,
+// negative delta narrows it again once they are released, like Celery does for ETA tasks
+func (b *AMQPCeleryBroker) HoldTasks(delta int) error {
+	b.lock.Lock()
+	b.held += delta
+	if b.held < 0 {
+		b.held = 0
+	}
+	b.lock.Unlock()
+	return b.session.do(b.qos)
+}
+
+// prefetchCount returns prefetch window of consumers, 0 for no limit; the lock must be held
+func (b *AMQPCeleryBroker) prefetchCount() int {
+	if b.multiplier <= 0 {
+		return 0
+	}
+	return b.multiplier*b.concurrency + b.held
+}
+
+// qos sets prefetch window shared by all consumers on channel, like Celery does on RabbitMQ,
+// so that changes apply to consumers already started
+func (b *AMQPCeleryBroker) qos(channel *amqp.Channel) error {
+	b.lock.Lock()
+	prefetch := b.prefetchCount()
+	b.lock.Unlock()
+	return channel.Qos(prefetch, 0, true)
+}
+
+// AddConsumer starts consuming queue, declaring it unless it is configured by BrokerQueues,
+// like add_consumer control command of Celery
+func (b *AMQPCeleryBroker) AddConsumer(name string) error {
+	b.lock.Lock()
+	if _, ok := b.consumers[name]; ok {
+		b.lock.Unlock()
+		return nil
+	}
+	b.consumers[name] = amqpConsumer{}
+	consuming := b.consuming
+	b.lock.Unlock()
+	if !consuming {
+		return nil
+	}
+	err := b.session.do(func(channel *amqp.Channel) error {
+		return b.consume(channel, name)
+	})
 	if err != nil {
-		return err
+		b.lock.Lock()
+		delete(b.consumers, name)
+		b.lock.Unlock()
+	}
+	return err
+}
+
+// CancelConsumer stops consuming queue, like cancel_consumer control command of Celery
+// Tasks already prefetched from it are still returned by GetTask.
+func (b *AMQPCeleryBroker) CancelConsumer(name string) error {
+	return b.cancel(name, true)
+}
+
+// ConsumedQueues returns names of consumed queues
+func (b *AMQPCeleryBroker) ConsumedQueues() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	names := make([]string, 0, len(b.consumers))
+	for name := range b.consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// cancel cancels consumer of queue, which is forgotten when remove is set
+func (b *AMQPCeleryBroker) cancel(name string, remove bool) error {
+	b.lock.Lock()
+	consumer, ok := b.consumers[name]
+	if remove {
+		delete(b.consumers, name)
+	} else if ok {
+		b.consumers[name] = amqpConsumer{}
+	}
+	b.lock.Unlock()
+	if !ok || consumer.channel == nil {
+		return nil
+	}
+	err := consumer.channel.Cancel(consumer.tag, false)
+	if err == amqp.ErrClosed {
+		// consumer is gone with its channel
+		return nil
+	}
+	return err
+}
+
+// consumeAll starts consumers of all queues not consumed on channel yet
+func (b *AMQPCeleryBroker) consumeAll(channel *amqp.Channel) error {
+	b.lock.Lock()
+	var names []string
+	for name, consumer := range b.consumers {
+		if consumer.channel != channel {
+			names = append(names, name)
+		}
+	}
+	b.lock.Unlock()
+	for _, name := range names {
+		if err := b.consume(channel, name); err != nil {
+			return err
+		}
 	}
-	b.consumingChannel = channel
 	return nil
 }
 
-// SendCeleryMessage sends CeleryMessage to broker
-func (b *AMQPCeleryBroker) SendCeleryMessage(message *CeleryMessage) error {
-	task := Msg2Task(message)
-	log.Printf("sending task Id %s\n", task.Id)
-	queueName := "celery"
-	_, err := b.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		false,     // autoDelete
-		false,     // exclusive
-		false,     // noWait
-		nil,       // args
-	)
-	if err != nil {
+// consume starts consumer of queue on channel, unless it was cancelled or it is consumed already
+func (b *AMQPCeleryBroker) consume(channel *amqp.Channel, name string) error {
+	b.lock.Lock()
+	consumer, ok := b.consumers[name]
+	b.lock.Unlock()
+	if !ok || consumer.channel == channel {
+		return nil
+	}
+	if err := b.declareQueue(channel, b.getQueue(name)); err != nil {
 		return err
 	}
-	err = b.ExchangeDeclare(
-		"default",
-		"direct",
-		true,
-		true,
-		false,
-		false,
-		nil,
-	)
+	if err := b.qos(channel); err != nil {
+		return err
+	}
+	tag := fmt.Sprintf("%s.%s", name, generateUUID())
+	deliveries, err := channel.Consume(name, tag, false, false, false, false, nil)
 	if err != nil {
 		return err
 	}
+	b.lock.Lock()
+	if _, ok := b.consumers[name]; ok {
+		b.consumers[name] = amqpConsumer{channel: channel, tag: tag}
+	} else {
+		// cancelled meanwhile
+		channel.Cancel(tag, false)
+	}
+	b.lock.Unlock()
+	go b.forward(channel, name, tag, deliveries)
+	return nil
+}
 
-	resBytes, err := json.Marshal(task)
+// forward passes deliveries of consumer to GetTask until it is cancelled
+func (b *AMQPCeleryBroker) forward(channel *amqp.Channel, name string, tag string, deliveries <-chan amqp.Delivery) {
+	for delivery := range deliveries {
+		select {
+		case b.deliveries <- delivery:
+		case <-b.session.done:
+			return
+		}
+	}
+	b.lock.Lock()
+	consumer := b.consumers[name]
+	b.lock.Unlock()
+	if consumer.tag == tag {
+		// consumer is cancelled by server, e.g. its queue was deleted, or with its channel
+		b.session.reset(channel, nil)
+	}
+}
+
+// Close closes connection to AMQP server
+func (b *AMQPCeleryBroker) Close() error {
+	return b.session.Close()
+}
+
+// SendCeleryMessage sends CeleryMessage to broker
+// It is published to exchange with routing key of its delivery info, to the consumed queue
+// when they are both empty. While connection is lost, it waits for reconnection.
+// With BrokerPublisherConfirms, it returns once the message is confirmed by AMQP server.
+func (b *AMQPCeleryBroker) SendCeleryMessage(message *CeleryMessage) error {
+	return b.SendCeleryMessages(message)
+}
+
+// SendCeleryMessages sends CeleryMessages like SendCeleryMessage
+// With BrokerPublisherConfirms, all of them are published before waiting for their confirms,
+// which is much faster than sending them one by one. The first error is returned, messages
+// published before connection was lost are sent again after reconnection.
+func (b *AMQPCeleryBroker) SendCeleryMessages(messages ...*CeleryMessage) error {
+	routes := make([]CeleryDeliveryInfo, len(messages))
+	publishings := make([]amqp.Publishing, len(messages))
+	for i, message := range messages {
+		log.Printf("sending task Id %s\n", message.Properties.CorrelationID)
+		routes[i] = message.Properties.DeliveryInfo
+		if routes[i].Exchange == "" && routes[i].RoutingKey == "" {
+			routes[i].RoutingKey = b.queue.Name
+		}
+		var err error
+		if publishings[i], err = amqpPublishing(message); err != nil {
+			return err
+		}
+	}
+	sent := make([]bool, len(messages))
+	var failed error
+	err := b.session.do(func(channel *amqp.Channel) error {
+		b.lock.Lock()
+		confirms := b.confirms
+		if b.confirmsChannel != channel {
+			confirms = nil
+		}
+		b.lock.Unlock()
+		if confirms == nil && b.confirm {
+			// channel was replaced meanwhile
+			return amqp.ErrClosed
+		}
+		waits := make([]<-chan error, len(messages))
+		for i, route := range routes {
+			if sent[i] {
+				continue
+			}
+			if err := b.declareRoute(channel, route); err != nil {
+				return err
+			}
+			if !b.confirm {
+				if err := channel.Publish(route.Exchange, route.RoutingKey, b.mandatory, false, publishings[i]); err != nil {
+					return err
+				}
+				sent[i] = true
+				continue
+			}
+			wait, err := confirms.publish(channel, route, b.mandatory, publishings[i])
+			if err != nil {
+				return err
+			}
+			waits[i] = wait
+		}
+		var closed error
+		for i, wait := range waits {
+			if wait == nil {
+				continue
+			}
+			err := <-wait
+			if err == amqp.ErrClosed {
+				// sent again after reconnection
+				closed = err
+				continue
+			}
+			sent[i] = true
+			if err != nil && failed == nil {
+				failed = err
+			}
+		}
+		return closed
+	})
 	if err != nil {
 		return err
 	}
+	return failed
+}
 
-	publishMessage := amqp.Publishing{
-		DeliveryMode: amqp.Persistent,
-		Timestamp:    time.Now(),
-		ContentType:  "application/json",
-		Body:         resBytes,
+// declareRoute declares exchange and queue of the route once, so that messages are not dropped
+// Like Celery with task_create_missing_queues, unknown queues are created and unknown exchanges
+// are created as direct exchanges routing to queue named by routing key.
+// The lock is not held while declaring: declarations are idempotent, so routes declared
+// concurrently are at worst declared twice.
+func (b *AMQPCeleryBroker) declareRoute(channel *amqp.Channel, route CeleryDeliveryInfo) error {
+	b.lock.Lock()
+	// declared is replaced on reconnection, routes declared on lost connection are not marked
+	declared := b.declared
+	done := declared[route]
+	b.lock.Unlock()
+	if done {
+		return nil
+	}
+	if route.Exchange == "" {
+		// default exchange routes to queue named by routing key
+		if err := b.declareQueue(channel, b.getQueue(route.RoutingKey)); err != nil {
+			return err
+		}
+	} else if exchange, ok := b.exchanges[route.Exchange]; ok {
+		// queues are bound when they are declared
+		if err := b.declareExchange(channel, exchange); err != nil {
+			return err
+		}
+	} else {
+		exchange := NewAMQPExchange(route.Exchange)
+		if err := b.declareExchange(channel, exchange); err != nil {
+			return err
+		}
+		queue := b.getQueue(route.RoutingKey)
+		if err := b.declareQueue(channel, queue); err != nil {
+			return err
+		}
+		if err := channel.QueueBind(queue.Name, route.RoutingKey, exchange.Name, false, nil); err != nil {
+			return err
+		}
 	}
+	b.lock.Lock()
+	declared[route] = true
+	b.lock.Unlock()
+	return nil
+}
 
-	return b.Publish(
-		"",
-		queueName,
-		false,
-		false,
-		publishMessage,
-	)
+// getQueue returns configured queue by name, or new queue
+func (b *AMQPCeleryBroker) getQueue(name string) *AMQPQueue {
+	if queue, ok := b.queues[name]; ok {
+		return queue
+	}
+	return NewAMQPQueue(name)
 }
 
-// GetTask retrieves task message from AMQP queue
+// GetTask retrieves task message from consumed AMQP queues
+// It starts consuming when it is called first, and returns no task when there is none
+// for a second, e.g. while connection is lost.
 func (b *AMQPCeleryBroker) GetTask() (*CeleryTask, error) {
-	delivery := <-b.consumingChannel
-	delivery.Ack(false)
-	var taskMessage CeleryTask
-	if err := json.Unmarshal(delivery.Body, &taskMessage); err != nil {
+	if err := b.StartConsumingChannel(); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(amqpGetTaskTimeout)
+	defer timer.Stop()
+	var delivery amqp.Delivery
+	select {
+	case delivery = <-b.deliveries:
+	case <-b.session.done:
+		return nil, amqp.ErrClosed
+	case <-timer.C:
+		return nil, nil
+	}
+	if !b.acksLate {
+		delivery.Ack(false)
+	}
+	message, err := amqpCeleryMessage(delivery)
+	if err != nil {
+		b.rejectInvalid(delivery)
+		return nil, err
+	}
+	task := Msg2Task(message)
+	if task == nil {
+		b.rejectInvalid(delivery)
+		return nil, fmt.Errorf("failed to decode task message %s", message.Properties.CorrelationID)
+	}
+	if b.acksLate {
+		task.Acknowledger = amqpAcknowledger{delivery}
+	}
+	return task, nil
+}
+
+// rejectInvalid rejects undecodable message which is acknowledged late, it would be delivered again otherwise
+func (b *AMQPCeleryBroker) rejectInvalid(delivery amqp.Delivery) {
+	if !b.acksLate {
+		return
+	}
+	if err := delivery.Reject(false); err != nil {
+		log.Printf("failed to reject message %s: %v", delivery.CorrelationId, err)
+	}
+}
+
+// amqpAcknowledger acknowledges delivery of task, on the channel it was received from
+type amqpAcknowledger struct {
+	delivery amqp.Delivery
+}
+
+func (a amqpAcknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+func (a amqpAcknowledger) Reject(requeue bool) error {
+	return a.delivery.Reject(requeue)
+}
+
+// maxAMQPExpiration is the longest expiration of message accepted by RabbitMQ
+const maxAMQPExpiration = math.MaxUint32 * time.Millisecond
+
+// amqpPublishing converts CeleryMessage into AMQP message like kombu publishes it:
+// protocol headers as AMQP headers, body as it was serialized and properties of the message
+// Priority takes effect in queues with MaxPriority, the message expires with the task unless
+// it is too far in the future.
+func amqpPublishing(message *CeleryMessage) (amqp.Publishing, error) {
+	body := []byte(message.Body)
+	if message.Properties.BodyEncoding == "base64" {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(message.Body); err != nil {
+			return amqp.Publishing{}, err
+		}
+	}
+	data, err := json.Marshal(message.Headers)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	var headers map[string]interface{}
+	if err := json.Unmarshal(data, &headers); err != nil {
+		return amqp.Publishing{}, err
+	}
+	table := amqpValue(headers).(amqp.Table)
+	if err := table.Validate(); err != nil {
+		return amqp.Publishing{}, err
+	}
+	priority := message.Properties.Priority
+	if priority < 0 {
+		priority = 0
+	} else if priority > 255 {
+		priority = 255
+	}
+	var expiration string
+	if expires := message.Headers.Expires; !expires.IsZero() {
+		if ttl := time.Until(expires); ttl <= 0 {
+			expiration = "0"
+		} else if ttl <= maxAMQPExpiration {
+			expiration = strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+		}
+	}
+	return amqp.Publishing{
+		Headers:         table,
+		ContentType:     message.ContentType,
+		ContentEncoding: message.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        uint8(priority),
+		Expiration:      expiration,
+		CorrelationId:   message.Properties.CorrelationID,
+		ReplyTo:         message.Properties.ReplyTo,
+		Timestamp:       time.Now(),
+		Body:            body,
+	}, nil
+}
+
+// amqpCeleryMessage converts AMQP message published by kombu or amqpPublishing into CeleryMessage
+func amqpCeleryMessage(delivery amqp.Delivery) (*CeleryMessage, error) {
+	headers := jsonValue(delivery.Headers)
+	if headers == nil {
+		headers = map[string]interface{}{}
+	}
+	data, err := json.Marshal(headers)
+	if err != nil {
 		return nil, err
 	}
-	return &taskMessage, nil
+	message := &CeleryMessage{
+		Body:            base64.StdEncoding.EncodeToString(delivery.Body),
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		Properties: ST_Properties{
+			CorrelationID: delivery.CorrelationId,
+			ReplyTo:       delivery.ReplyTo,
+			BodyEncoding:  "base64",
+			Priority:      int(delivery.Priority),
+			DeliveryInfo: CeleryDeliveryInfo{
+				RoutingKey: delivery.RoutingKey,
+				Exchange:   delivery.Exchange,
+			},
+			DeliveryMode: int(delivery.DeliveryMode),
+			DeliveryTag:  strconv.FormatUint(delivery.DeliveryTag, 10),
+		},
+	}
+	if err := json.Unmarshal(data, &message.Headers); err != nil {
+		return nil, fmt.Errorf("malformed headers of message %s: %v", delivery.CorrelationId, err)
+	}
+	return message, nil
+}
+
+// amqpValue converts generic json value into value of AMQP table
+// Integral numbers are sent as integers, like Python sends retries or priority.
+func amqpValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		table := make(amqp.Table, len(v))
+		for k, item := range v {
+			table[k] = amqpValue(item)
+		}
+		return table
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = amqpValue(item)
+		}
+		return values
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// jsonValue converts value of AMQP table into generic json value
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case amqp.Table:
+		if v == nil {
+			return nil
+		}
+		values := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			values[k] = jsonValue(item)
+		}
+		return values
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = jsonValue(item)
+		}
+		return values
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case amqp.Decimal:
+		return float64(v.Value) / math.Pow10(int(v.Scale))
+	default:
+		return v
+	}
 }
 
 // CreateExchange declares AMQP exchange with stored configuration
 func (b *AMQPCeleryBroker) CreateExchange() error {
-	return b.ExchangeDeclare(
-		b.exchange.Name,
-		b.exchange.Type,
-		b.exchange.Durable,
-		b.exchange.AutoDelete,
+	return b.session.do(func(channel *amqp.Channel) error {
+		return b.declareExchange(channel, b.exchange)
+	})
+}
+
+// CreateQueue declares AMQP Queue with stored configuration
+func (b *AMQPCeleryBroker) CreateQueue() error {
+	return b.session.do(func(channel *amqp.Channel) error {
+		return b.declareQueue(channel, b.queue)
+	})
+}
+
+// declareExchange declares AMQP exchange, the default exchange always exists
+func (b *AMQPCeleryBroker) declareExchange(channel *amqp.Channel, exchange *AMQPExchange) error {
+	if exchange.Name == "" {
+		return nil
+	}
+	return channel.ExchangeDeclare(
+		exchange.Name,
+		exchange.Type,
+		exchange.Durable,
+		exchange.AutoDelete,
 		false,
 		false,
 		nil,
 	)
 }
 
-// CreateQueue declares AMQP Queue with stored configuration
-func (b *AMQPCeleryBroker) CreateQueue() error {
-	_, err := b.QueueDeclare(
-		b.queue.Name,
-		b.queue.Durable,
-		b.queue.AutoDelete,
+// declareQueue declares AMQP queue and binds it to its exchange
+func (b *AMQPCeleryBroker) declareQueue(channel *amqp.Channel, queue *AMQPQueue) error {
+	args, err := queue.arguments()
+	if err != nil {
+		return err
+	}
+	_, err = channel.QueueDeclare(
+		queue.Name,
+		queue.Durable,
+		queue.AutoDelete,
 		false,
 		false,
-		nil,
+		args,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	exchange := queue.Exchange
+	if exchange == nil {
+		exchange = b.exchange
+	}
+	if exchange.Name == "" {
+		return nil
+	}
+	if err := b.declareExchange(channel, exchange); err != nil {
+		return err
+	}
+	routingKey := queue.RoutingKey
+	if routingKey == "" {
+		routingKey = queue.Name
+	}
+	return channel.QueueBind(queue.Name, routingKey, exchange.Name, false, nil)
 }
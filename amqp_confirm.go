@@ -0,0 +1,134 @@
+package gocelery
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// amqpConfirms tracks publisher confirms and returned messages of a channel
+// Messages are numbered in the order they are published, like delivery tags of confirms,
+// so publishing and numbering are done under lock.
+type amqpConfirms struct {
+	lock    sync.Mutex
+	tag     uint64
+	pending map[uint64]*amqpPendingPublish
+}
+
+// amqpPendingPublish is message waiting for confirmation
+type amqpPendingPublish struct {
+	correlationID string
+	done          chan error
+	err           error
+}
+
+// newAMQPConfirms starts listening to returned messages of channel and to its confirms if confirm is set
+func newAMQPConfirms(channel *amqp.Channel, confirm bool) (*amqpConfirms, error) {
+	var confirms chan amqp.Confirmation
+	if confirm {
+		if err := channel.Confirm(false); err != nil {
+			return nil, err
+		}
+		confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 64))
+	}
+	returns := channel.NotifyReturn(make(chan amqp.Return, 16))
+	c := &amqpConfirms{pending: make(map[uint64]*amqpPendingPublish)}
+	go c.listen(returns, confirms)
+	return c, nil
+}
+
+// publish publishes message, returned channel receives error once it is confirmed
+func (c *amqpConfirms) publish(channel *amqp.Channel, route CeleryDeliveryInfo, mandatory bool, message amqp.Publishing) (<-chan error, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := channel.Publish(route.Exchange, route.RoutingKey, mandatory, false, message); err != nil {
+		return nil, err
+	}
+	return c.track(message.CorrelationId), nil
+}
+
+// track registers next published message, it must be called under lock
+func (c *amqpConfirms) track(correlationID string) <-chan error {
+	c.tag++
+	pending := &amqpPendingPublish{
+		correlationID: correlationID,
+		done:          make(chan error, 1),
+	}
+	c.pending[c.tag] = pending
+	return pending.done
+}
+
+// listen dispatches returns and confirms until the channel is closed
+// Pending messages then fail with amqp.ErrClosed, so that they are published again.
+func (c *amqpConfirms) listen(returns <-chan amqp.Return, confirms <-chan amqp.Confirmation) {
+	defer c.close()
+	for {
+		select {
+		case returned, ok := <-returns:
+			if !ok {
+				return
+			}
+			c.returned(returned)
+		case confirmation, ok := <-confirms:
+			if !ok {
+				return
+			}
+			// message is returned before it is confirmed, but its return may not be received yet
+			for drained := false; !drained; {
+				select {
+				case returned, ok := <-returns:
+					if !ok {
+						return
+					}
+					c.returned(returned)
+				default:
+					drained = true
+				}
+			}
+			c.confirmed(confirmation)
+		}
+	}
+}
+
+// returned records returned unroutable message as error of its publication
+func (c *amqpConfirms) returned(returned amqp.Return) {
+	err := fmt.Errorf("message %s returned by exchange %q with routing key %q: %d %s", returned.CorrelationId,
+		returned.Exchange, returned.RoutingKey, returned.ReplyCode, returned.ReplyText)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, pending := range c.pending {
+		if pending.correlationID == returned.CorrelationId && pending.err == nil {
+			pending.err = err
+			return
+		}
+	}
+	// publisher confirms are disabled
+	log.Print(err)
+}
+
+// confirmed notifies publisher of confirmed message
+func (c *amqpConfirms) confirmed(confirmation amqp.Confirmation) {
+	c.lock.Lock()
+	pending, ok := c.pending[confirmation.DeliveryTag]
+	delete(c.pending, confirmation.DeliveryTag)
+	c.lock.Unlock()
+	if !ok {
+		return
+	}
+	if !confirmation.Ack && pending.err == nil {
+		pending.err = fmt.Errorf("message %s rejected by AMQP server", pending.correlationID)
+	}
+	pending.done <- pending.err
+}
+
+// close fails pending messages
+func (c *amqpConfirms) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for tag, pending := range c.pending {
+		pending.done <- amqp.ErrClosed
+		delete(c.pending, tag)
+	}
+}
@@ -0,0 +1,266 @@
+package gocelery
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// defaultAMQPTimeout is how long operations wait for AMQP connection to be reestablished
+	defaultAMQPTimeout = 30 * time.Second
+	// minAMQPBackoff and maxAMQPBackoff bound delay between reconnection attempts
+	minAMQPBackoff = 500 * time.Millisecond
+	maxAMQPBackoff = 30 * time.Second
+	// maxPooledChannels is number of idle channels kept for concurrent operations
+	maxPooledChannels = 16
+)
+
+// amqpSession keeps AMQP connection and channel open
+// When either of them is closed, it reconnects with exponential backoff and calls setup
+// on the new channel to declare exchanges and queues again and resume consuming.
+type amqpSession struct {
+	host    string
+	setup   func(channel *amqp.Channel) error
+	timeout time.Duration
+
+	lock       sync.Mutex
+	connection *amqp.Connection
+	channel    *amqp.Channel
+	// ready is closed while connected, it is replaced by an open channel while reconnecting
+	ready   chan struct{}
+	lastErr error
+	done    chan struct{}
+	// pool are idle channels of the connection, see doPooled
+	pool []*amqp.Channel
+}
+
+// newAMQPSession connects to AMQP server, setup may be nil
+// Operations wait up to timeout for reconnection, 0 makes them fail immediately while disconnected.
+func newAMQPSession(host string, timeout time.Duration, setup func(channel *amqp.Channel) error) (*amqpSession, error) {
+	s := &amqpSession{
+		host:    host,
+		setup:   setup,
+		timeout: timeout,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect opens connection and channel and sets them up
+func (s *amqpSession) connect() error {
+	connection, channel, err := NewAMQPConnection(s.host)
+	if err != nil {
+		return err
+	}
+	if s.setup != nil {
+		if err := s.setup(channel); err != nil {
+			connection.Close()
+			return err
+		}
+	}
+	connectionClosed := connection.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	s.lock.Lock()
+	select {
+	case <-s.done:
+		s.lock.Unlock()
+		connection.Close()
+		return amqp.ErrClosed
+	default:
+	}
+	s.connection = connection
+	s.channel = channel
+	s.lastErr = nil
+	close(s.ready)
+	s.lock.Unlock()
+	go func() {
+		var err *amqp.Error
+		select {
+		case err = <-connectionClosed:
+		case err = <-channelClosed:
+		case <-s.done:
+			return
+		}
+		if err == nil {
+			s.reset(channel, nil)
+			return
+		}
+		log.Printf("AMQP connection lost: %v", err)
+		s.reset(channel, err)
+	}()
+	return nil
+}
+
+// reset closes connection of channel and starts reconnecting, unless it was already done
+func (s *amqpSession) reset(channel *amqp.Channel, cause error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.channel != channel || s.channel == nil {
+		return
+	}
+	s.connection.Close()
+	s.connection = nil
+	s.channel = nil
+	s.pool = nil
+	if cause == nil {
+		cause = amqp.ErrClosed
+	}
+	s.lastErr = cause
+	s.ready = make(chan struct{})
+	go s.reconnect()
+}
+
+// reconnect connects again until it succeeds or the session is closed
+func (s *amqpSession) reconnect() {
+	backoff := minAMQPBackoff
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(backoff):
+		}
+		err := s.connect()
+		if err == nil {
+			log.Printf("AMQP connection reestablished")
+			return
+		}
+		log.Printf("AMQP reconnection failed, retrying in %s: %v", backoff, err)
+		s.lock.Lock()
+		s.lastErr = err
+		s.lock.Unlock()
+		if backoff *= 2; backoff > maxAMQPBackoff {
+			backoff = maxAMQPBackoff
+		}
+	}
+}
+
+// get returns open channel, waiting for reconnection until timeout
+func (s *amqpSession) get(timeout time.Duration) (*amqp.Channel, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.lock.Lock()
+		ready, channel, lastErr := s.ready, s.channel, s.lastErr
+		s.lock.Unlock()
+		select {
+		case <-s.done:
+			return nil, amqp.ErrClosed
+		case <-ready:
+			return channel, nil
+		default:
+		}
+		select {
+		case <-ready:
+		case <-s.done:
+			return nil, amqp.ErrClosed
+		case <-timer.C:
+			return nil, fmt.Errorf("AMQP connection is down: %v", lastErr)
+		}
+	}
+}
+
+// do calls f with open channel, again after reconnection if the channel is closed meanwhile
+// Errors of AMQP server, e.g. declaration of queue with different arguments, are returned as they are.
+func (s *amqpSession) do(f func(channel *amqp.Channel) error) error {
+	deadline := time.Now().Add(s.timeout)
+	for {
+		channel, err := s.get(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		err = f(channel)
+		if err != amqp.ErrClosed {
+			return err
+		}
+		s.reset(channel, err)
+		if !time.Now().Before(deadline) {
+			return err
+		}
+	}
+}
+
+// doPooled is like do, but calls f with a channel of its own, so that concurrent callers
+// do not share channels
+// Channels are reused unless f fails, as AMQP server closes channel on most errors.
+func (s *amqpSession) doPooled(f func(channel *amqp.Channel) error) error {
+	deadline := time.Now().Add(s.timeout)
+	for {
+		main, err := s.get(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		channel, connection, err := s.acquire(main)
+		if err == nil {
+			err = f(channel)
+			s.release(main, channel, err)
+		}
+		if err != amqp.ErrClosed {
+			return err
+		}
+		if connection == nil || connection.IsClosed() {
+			s.reset(main, err)
+		}
+		if !time.Now().Before(deadline) {
+			return err
+		}
+	}
+}
+
+// acquire takes idle channel of the connection of main channel, or opens a new one
+func (s *amqpSession) acquire(main *amqp.Channel) (*amqp.Channel, *amqp.Connection, error) {
+	s.lock.Lock()
+	if s.channel != main {
+		// reconnected meanwhile
+		s.lock.Unlock()
+		return nil, nil, amqp.ErrClosed
+	}
+	connection := s.connection
+	if n := len(s.pool); n > 0 {
+		channel := s.pool[n-1]
+		s.pool = s.pool[:n-1]
+		s.lock.Unlock()
+		return channel, connection, nil
+	}
+	s.lock.Unlock()
+	channel, err := connection.Channel()
+	return channel, connection, err
+}
+
+// release returns channel to the pool, unless it failed or its connection was replaced
+func (s *amqpSession) release(main *amqp.Channel, channel *amqp.Channel, err error) {
+	if err == nil {
+		s.lock.Lock()
+		if s.channel == main && len(s.pool) < maxPooledChannels {
+			s.pool = append(s.pool, channel)
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+	}
+	channel.Close()
+}
+
+// Close closes the session for good
+func (s *amqpSession) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	if s.connection == nil {
+		return nil
+	}
+	s.channel = nil
+	return s.connection.Close()
+}
@@ -5,12 +5,19 @@ import (
     "math/rand"
     "reflect"
     "testing"
+    "time"
+
+    "github.com/streadway/amqp"
 )
 
 func getBackends() []CeleryBackend {
+    amqpBackend, err := NewAMQPCeleryBackend("amqp://")
+    if err != nil {
+        panic(err)
+    }
     return []CeleryBackend{
         NewRedisCeleryBackend("localhost", 6379, 0, ""),
-        NewAMQPCeleryBackend("amqp://"),
+        amqpBackend,
     }
 }
 
@@ -74,6 +81,58 @@ func TestSetResult(t *testing.T) {
     }
 }
 
+// TestWaitResult is Redis specific test of results notified through pub/sub
+func TestWaitResult(t *testing.T) {
+    backend := NewRedisCeleryBackend("localhost", 6379, 0, "")
+    taskID := generateUUID()
+    asyncResult := &AsyncResult{taskID: taskID, backend: backend}
+    go func() {
+        time.Sleep(100 * time.Millisecond)
+        backend.SetResult(taskID, getResultMessage(float64(3)))
+    }()
+    start := time.Now()
+    res, err := asyncResult.Get(5 * time.Second)
+    if err != nil || res != float64(3) {
+        t.Errorf("unexpected result %v: %v", res, err)
+    }
+    // polling would wait a second
+    if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+        t.Errorf("result received after %v", elapsed)
+    }
+    backend.subscriber.lock.Lock()
+    waiting := len(backend.subscriber.waiters)
+    backend.subscriber.lock.Unlock()
+    if waiting != 0 {
+        t.Errorf("%d channels still subscribed", waiting)
+    }
+
+    // subscription is restored when connection is lost
+    taskID = generateUUID()
+    notify, cancel, err := backend.WaitResult(taskID)
+    if err != nil {
+        t.Fatalf("error subscribing to result: %v", err)
+    }
+    defer cancel()
+    waitNotify := func(event string) {
+        select {
+        case <-notify:
+        case <-time.After(5 * time.Second):
+            t.Fatalf("not notified of %s", event)
+        }
+    }
+    waitNotify("subscription")
+    conn := backend.Get()
+    defer conn.Close()
+    if _, err := conn.Do("CLIENT", "KILL", "TYPE", "pubsub"); err != nil {
+        t.Fatalf("error killing subscriber connection: %v", err)
+    }
+    waitNotify("resubscription")
+    if err := backend.SetResult(taskID, getResultMessage(float64(4))); err != nil {
+        t.Fatalf("error setting result to backend: %v", err)
+    }
+    waitNotify("result")
+}
+
 // TestSetGetResult tests set/get result feature for all backends
 func TestSetGetResult(t *testing.T) {
     for _, backend := range getBackends() {
@@ -96,3 +155,124 @@ func TestSetGetResult(t *testing.T) {
         }
     }
 }
+
+func TestRPCBackendReceive(t *testing.T) {
+    backend := &RPCCeleryBackend{
+        options:  newBackendOptions(nil),
+        results:  make(map[string]*ResultMessage),
+        received: make(map[string]uint64),
+    }
+    deliveries := make(chan amqp.Delivery, 3)
+    for _, body := range []string{
+        `{"task_id": "t1", "status": "PROGRESS", "result": {"current": 1}, "traceback": null, "children": []}`,
+        `{"task_id": "t1", "status": "SUCCESS", "result": 3, "traceback": null, "children": []}`,
+        `{"task_id": "t1", "status": "PROGRESS", "result": {"current": 2}, "traceback": null, "children": []}`,
+    } {
+        deliveries <- amqp.Delivery{ContentType: "application/json", CorrelationId: "t1", Body: []byte(body)}
+    }
+    close(deliveries)
+    if _, err := backend.GetResult("t1"); err != ErrResultNotAvailable {
+        t.Errorf("unexpected error before result is received: %v", err)
+    }
+    backend.receive(deliveries)
+    result, err := backend.GetResult("t1")
+    if err != nil || result.Status != StateSuccess || result.Result != float64(3) {
+        t.Errorf("unexpected result %v: %v", result, err)
+    }
+    if _, err := backend.GetResult("t1"); err != ErrResultNotAvailable {
+        t.Errorf("final result must be returned once: %v", err)
+    }
+}
+
+func TestRPCBackendBounded(t *testing.T) {
+    backend := &RPCCeleryBackend{
+        options:  newBackendOptions(nil),
+        results:  make(map[string]*ResultMessage),
+        received: make(map[string]uint64),
+    }
+    backend.store("again", getResultMessage(1))
+    backend.GetResult("again")
+    for i := 0; i < maxRPCResults-1; i++ {
+        backend.store(fmt.Sprintf("t%d", i), getResultMessage(i))
+    }
+    // received again after it was retrieved, it is newer than t0
+    backend.store("again", getResultMessage(2))
+    backend.store("last", getResultMessage(3))
+    if _, err := backend.GetResult("t0"); err != ErrResultNotAvailable {
+        t.Errorf("oldest result was not dropped")
+    }
+    for _, taskID := range []string{"again", "t1", "last"} {
+        if _, err := backend.GetResult(taskID); err != nil {
+            t.Errorf("result of %s was dropped: %v", taskID, err)
+        }
+    }
+    for i := 0; i < 3*maxRPCResults; i++ {
+        backend.store(fmt.Sprintf("u%d", i), getResultMessage(i))
+    }
+    if len(backend.results) != maxRPCResults || len(backend.order) > 2*maxRPCResults {
+        t.Errorf("%d results and %d ids kept", len(backend.results), len(backend.order))
+    }
+}
+
+// replyBackend is memoryBackend recording reply_to of results
+type replyBackend struct {
+    *memoryBackend
+    replies []string
+}
+
+func (b *replyBackend) ReplyTo() string {
+    return "replies"
+}
+
+func (b *replyBackend) SetTaskResult(task *CeleryTask, result *ResultMessage) error {
+    b.replies = append(b.replies, task.ReplyTo)
+    return b.SetResult(task.Id, result)
+}
+
+func TestReplyBackend(t *testing.T) {
+    broker, backend := &memoryBroker{}, &replyBackend{memoryBackend: newMemoryBackend()}
+    client, _ := NewCeleryClient(broker, backend)
+    celeryWorker := NewCeleryWorker(broker, backend, 1)
+    celeryWorker.Register("add", add)
+    asyncResult, err := client.Delay("add", 1, 2)
+    if err != nil {
+        t.Fatalf("failed to send task: %v", err)
+    }
+    properties := broker.messages[0].Properties
+    if properties.ReplyTo != "replies" || properties.CorrelationID != asyncResult.GetTaskId() {
+        t.Errorf("unexpected properties %+v", properties)
+    }
+    celeryWorker.processTask(0)
+    if len(backend.replies) != 1 || backend.replies[0] != "replies" {
+        t.Errorf("unexpected replies %v", backend.replies)
+    }
+    if res, err := asyncResult.Get(time.Second); err != nil || res != float64(3) {
+        t.Errorf("unexpected result %v: %v", res, err)
+    }
+}
+
+func TestAMQPBackendState(t *testing.T) {
+    backend := &AMQPCeleryBackend{options: newBackendOptions(nil), states: make(map[string]*ResultMessage)}
+    delivery := func(status string) amqp.Delivery {
+        return amqp.Delivery{
+            ContentType: "application/json",
+            Body:        []byte(fmt.Sprintf(`{"task_id": "t1", "status": "%s", "result": null, "traceback": null, "children": []}`, status)),
+        }
+    }
+    if _, err := backend.updateState("t1", nil); err != ErrResultNotAvailable {
+        t.Errorf("unexpected error without result: %v", err)
+    }
+    if result, err := backend.updateState("t1", []amqp.Delivery{delivery(StateStarted), delivery("PROGRESS")}); err != nil || result.Status != "PROGRESS" {
+        t.Errorf("unexpected state %v: %v", result, err)
+    }
+    // state is kept once its message is consumed
+    if result, err := backend.updateState("t1", nil); err != nil || result.Status != "PROGRESS" {
+        t.Errorf("unexpected state %v: %v", result, err)
+    }
+    if result, err := backend.updateState("t1", []amqp.Delivery{delivery(StateSuccess)}); err != nil || result.Status != StateSuccess {
+        t.Errorf("unexpected state %v: %v", result, err)
+    }
+    if _, err := backend.updateState("t1", nil); err != ErrResultNotAvailable {
+        t.Errorf("final result must be returned once: %v", err)
+    }
+}
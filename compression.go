@@ -0,0 +1,111 @@
+package gocelery
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compressor compresses serialized message bodies, like kombu compression methods
+type Compressor interface {
+	// ContentType is sent as compression header of compressed messages
+	ContentType() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// compressorRegistry keeps compressors by name and by content type
+var compressorRegistry = struct {
+	sync.RWMutex
+	byName        map[string]Compressor
+	byContentType map[string]Compressor
+}{
+	byName:        make(map[string]Compressor),
+	byContentType: make(map[string]Compressor),
+}
+
+// RegisterCompressor registers compressor by name and by its content type,
+// replacing any compressor previously registered with the same name or content type
+func RegisterCompressor(name string, compressor Compressor) {
+	compressorRegistry.Lock()
+	defer compressorRegistry.Unlock()
+	compressorRegistry.byName[name] = compressor
+	compressorRegistry.byContentType[compressor.ContentType()] = compressor
+}
+
+// GetCompressor retrieves registered compressor by name or content type
+func GetCompressor(name string) (Compressor, error) {
+	compressorRegistry.RLock()
+	defer compressorRegistry.RUnlock()
+	if compressor, ok := compressorRegistry.byName[name]; ok {
+		return compressor, nil
+	}
+	if compressor, ok := compressorRegistry.byContentType[name]; ok {
+		return compressor, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", name)
+}
+
+func init() {
+	// kombu registers gzip as an alias of zlib
+	RegisterCompressor("zlib", &zlibCompressor{})
+	RegisterCompressor("gzip", &zlibCompressor{})
+	RegisterCompressor("bzip2", &bzip2Compressor{})
+}
+
+// zlibCompressor is compatible with kombu zlib and gzip compression
+type zlibCompressor struct{}
+
+func (c *zlibCompressor) ContentType() string {
+	return "application/x-gzip"
+}
+
+func (c *zlibCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := zlib.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress accepts zlib data sent by kombu and gzip data sent by other producers
+func (c *zlibCompressor) Decompress(data []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	if len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b {
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	} else {
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// bzip2Compressor decompresses messages compressed with kombu bzip2 compression
+// The standard library has no bzip2 encoder, so compressing fails until a Compressor
+// with a proper encoder is registered as bzip2.
+type bzip2Compressor struct{}
+
+func (c *bzip2Compressor) ContentType() string {
+	return "application/x-bz2"
+}
+
+func (c *bzip2Compressor) Compress(data []byte) ([]byte, error) {
+	return nil, fmt.Errorf("bzip2 compression is not supported, only decompression")
+}
+
+func (c *bzip2Compressor) Decompress(data []byte) ([]byte, error) {
+	return ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+}
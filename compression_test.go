@@ -0,0 +1,118 @@
+package gocelery
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressors(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte(strings.Repeat("ab", 1000)),
+		[]byte(strings.Repeat("x", 300)),
+		random,
+	}
+	for _, name := range []string{"zlib", "gzip"} {
+		compressor, err := GetCompressor(name)
+		if err != nil {
+			t.Fatalf("compression %s is not registered: %v", name, err)
+		}
+		for _, input := range inputs {
+			data, err := compressor.Compress(input)
+			if err != nil {
+				t.Fatalf("failed to compress with %s: %v", name, err)
+			}
+			output, err := compressor.Decompress(data)
+			if err != nil {
+				t.Fatalf("failed to decompress with %s: %v", name, err)
+			}
+			if !bytes.Equal(input, output) {
+				t.Errorf("%s round trip of %d bytes returned %d bytes", name, len(input), len(output))
+			}
+		}
+	}
+}
+
+func TestCompressorGzipInput(t *testing.T) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte("gzipped"))
+	writer.Close()
+	compressor, _ := GetCompressor("application/x-gzip")
+	output, err := compressor.Decompress(buf.Bytes())
+	if err != nil || string(output) != "gzipped" {
+		t.Errorf("failed to decompress gzip data: %q %v", output, err)
+	}
+}
+
+func TestCompressorBzip2(t *testing.T) {
+	// compressed by kombu, i.e. Python bz2 module
+	data := []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xc3\x27\x66\x30\x00\x00\x02\x11\x80\x40\x00\x1e\x0a\xda\x20\x20\x00\x22\x21\xa6\x9e\x91\xed\x50\x80\x68\x02\x45\x22\x0d\xb8\x6e\xc5\x64\x7c\x5d\xc9\x14\xe1\x42\x43\x0c\x9d\x98\xc0")
+	compressor, _ := GetCompressor("application/x-bz2")
+	output, err := compressor.Decompress(data)
+	if err != nil || string(output) != "compressed by kombu" {
+		t.Errorf("failed to decompress bzip2 data: %q %v", output, err)
+	}
+	if _, err := compressor.Compress(output); err == nil {
+		t.Errorf("bzip2 compression is not supported")
+	}
+}
+
+// identityCompressor is custom compressor leaving data as it is
+type identityCompressor struct{}
+
+func (c *identityCompressor) ContentType() string {
+	return "application/x-identity"
+}
+
+func (c *identityCompressor) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (c *identityCompressor) Decompress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func TestApplyAsyncCompression(t *testing.T) {
+	RegisterCompressor("identity", &identityCompressor{})
+	broker := &memoryBroker{}
+	client, err := NewCeleryClient(broker, nil, ClientCompression("zlib"))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if _, err := client.Delay("add", float64(1), float64(2)); err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	if _, err := client.ApplyAsync("add", []interface{}{float64(3)}, nil, nil, nil, false, "", 0, "", "",
+		ApplyCompression("identity"), ApplySerializer("msgpack")); err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	if _, err := client.ApplyAsync("add", []interface{}{float64(3)}, nil, nil, nil, false, "", 0, "", "",
+		ApplyCompression("bzip2")); err == nil {
+		t.Errorf("task compressed with bzip2 was sent")
+	}
+	expected := []string{"application/x-gzip", "application/x-identity"}
+	for i, msg := range broker.messages {
+		if msg.Headers.Compression != expected[i] {
+			t.Errorf("unexpected compression header %s", msg.Headers.Compression)
+		}
+	}
+	for range expected {
+		task, err := broker.GetTask()
+		if err != nil || task == nil {
+			t.Fatalf("failed to decode compressed task: %v", err)
+		}
+		if len(task.Args) == 0 {
+			t.Errorf("unexpected args %v", task.Args)
+		}
+	}
+	if _, err := NewCeleryClient(broker, nil, ClientCompression("lzma")); err == nil {
+		t.Errorf("unsupported compression was accepted")
+	}
+}
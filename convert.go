@@ -1,13 +1,18 @@
 package gocelery
 
 import (
+    "fmt"
+    "math"
     "reflect"
+    "strconv"
+    "strings"
+    "time"
 )
 
 // GetRealValue returns real value of reflect.Value
 // Required for JSON Marshalling
 func GetRealValue(val *reflect.Value) interface{} {
-    if val == nil {
+    if val == nil || !val.IsValid() {
         return nil
     }
     switch val.Kind() {
@@ -21,7 +26,314 @@ func GetRealValue(val *reflect.Value) interface{} {
         return val.Uint()
     case reflect.Float32, reflect.Float64:
         return val.Float()
-    default:
+    case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+        if val.IsNil() {
+            return nil
+        }
+        return val.Interface()
+    case reflect.Func, reflect.Chan, reflect.UnsafePointer:
         return nil
+    default:
+        // arrays and structs are stored intact
+        return val.Interface()
+    }
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// timeLayouts are accepted layouts of time arguments, Python isoformat() output included
+var timeLayouts = []string{
+    time.RFC3339Nano,
+    "2006-01-02T15:04:05.999999999",
+    "2006-01-02 15:04:05.999999999Z07:00",
+    "2006-01-02 15:04:05.999999999",
+    "2006-01-02",
+}
+
+// ConvertArg converts decoded message argument into value of type t
+// Numbers are widened or narrowed with overflow checks, slices, maps, pointers and
+// structs (via json field tags) are converted recursively, and time.Time is parsed
+// from ISO8601 strings or unix timestamps.
+func ConvertArg(arg interface{}, t reflect.Type) (reflect.Value, error) {
+    if arg == nil {
+        switch t.Kind() {
+        case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+            return reflect.Zero(t), nil
+        }
+        return reflect.Value{}, fmt.Errorf("cannot use null as %s", t)
+    }
+    val := reflect.ValueOf(arg)
+    if val.Type().AssignableTo(t) {
+        return val.Convert(t), nil
+    }
+    if t.Kind() == reflect.Interface {
+        return reflect.Value{}, fmt.Errorf("%T does not implement %s", arg, t)
+    }
+    if t == timeType {
+        return convertTime(arg)
+    }
+    switch t.Kind() {
+    case reflect.Ptr:
+        elem, err := ConvertArg(arg, t.Elem())
+        if err != nil {
+            return reflect.Value{}, err
+        }
+        ptr := reflect.New(t.Elem())
+        ptr.Elem().Set(elem)
+        return ptr, nil
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return convertInt(val, t)
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        return convertUint(val, t)
+    case reflect.Float32, reflect.Float64:
+        return convertFloat(val, t)
+    case reflect.Bool:
+        if val.Kind() != reflect.Bool {
+            break
+        }
+        return val.Convert(t), nil
+    case reflect.String:
+        if val.Kind() != reflect.String {
+            break
+        }
+        return val.Convert(t), nil
+    case reflect.Slice:
+        if t.Elem().Kind() == reflect.Uint8 && val.Kind() == reflect.String {
+            return val.Convert(t), nil
+        }
+        if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+            break
+        }
+        slice := reflect.MakeSlice(t, val.Len(), val.Len())
+        for i := 0; i < val.Len(); i++ {
+            elem, err := ConvertArg(val.Index(i).Interface(), t.Elem())
+            if err != nil {
+                return reflect.Value{}, fmt.Errorf("index %d: %v", i, err)
+            }
+            slice.Index(i).Set(elem)
+        }
+        return slice, nil
+    case reflect.Array:
+        if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+            break
+        }
+        if val.Len() != t.Len() {
+            return reflect.Value{}, fmt.Errorf("cannot use %d elements as %s", val.Len(), t)
+        }
+        array := reflect.New(t).Elem()
+        for i := 0; i < val.Len(); i++ {
+            elem, err := ConvertArg(val.Index(i).Interface(), t.Elem())
+            if err != nil {
+                return reflect.Value{}, fmt.Errorf("index %d: %v", i, err)
+            }
+            array.Index(i).Set(elem)
+        }
+        return array, nil
+    case reflect.Map:
+        if val.Kind() != reflect.Map {
+            break
+        }
+        m := reflect.MakeMapWithSize(t, val.Len())
+        iter := val.MapRange()
+        for iter.Next() {
+            key, err := convertMapKey(iter.Key().Interface(), t.Key())
+            if err != nil {
+                return reflect.Value{}, err
+            }
+            elem, err := ConvertArg(iter.Value().Interface(), t.Elem())
+            if err != nil {
+                return reflect.Value{}, fmt.Errorf("key %v: %v", iter.Key().Interface(), err)
+            }
+            m.SetMapIndex(key, elem)
+        }
+        return m, nil
+    case reflect.Struct:
+        if val.Kind() != reflect.Map {
+            break
+        }
+        s := reflect.New(t).Elem()
+        if err := setStructFields(s, val); err != nil {
+            return reflect.Value{}, err
+        }
+        return s, nil
+    }
+    return reflect.Value{}, fmt.Errorf("cannot convert %v (%T) to %s", arg, arg, t)
+}
+
+// convertInt converts numeric val into signed integer type t
+func convertInt(val reflect.Value, t reflect.Type) (reflect.Value, error) {
+    res := reflect.New(t).Elem()
+    switch val.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        if res.OverflowInt(val.Int()) {
+            return reflect.Value{}, fmt.Errorf("%d overflows %s", val.Int(), t)
+        }
+        res.SetInt(val.Int())
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        if val.Uint() > math.MaxInt64 || res.OverflowInt(int64(val.Uint())) {
+            return reflect.Value{}, fmt.Errorf("%d overflows %s", val.Uint(), t)
+        }
+        res.SetInt(int64(val.Uint()))
+    case reflect.Float32, reflect.Float64:
+        f := val.Float()
+        if f != math.Trunc(f) {
+            return reflect.Value{}, fmt.Errorf("cannot convert %v to %s without losing precision", f, t)
+        }
+        if f < math.MinInt64 || f >= math.MaxInt64 || res.OverflowInt(int64(f)) {
+            return reflect.Value{}, fmt.Errorf("%v overflows %s", f, t)
+        }
+        res.SetInt(int64(f))
+    default:
+        return reflect.Value{}, fmt.Errorf("cannot convert %v (%s) to %s", val.Interface(), val.Type(), t)
+    }
+    return res, nil
+}
+
+// convertUint converts numeric val into unsigned integer type t
+func convertUint(val reflect.Value, t reflect.Type) (reflect.Value, error) {
+    res := reflect.New(t).Elem()
+    switch val.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        if val.Int() < 0 || res.OverflowUint(uint64(val.Int())) {
+            return reflect.Value{}, fmt.Errorf("%d overflows %s", val.Int(), t)
+        }
+        res.SetUint(uint64(val.Int()))
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        if res.OverflowUint(val.Uint()) {
+            return reflect.Value{}, fmt.Errorf("%d overflows %s", val.Uint(), t)
+        }
+        res.SetUint(val.Uint())
+    case reflect.Float32, reflect.Float64:
+        f := val.Float()
+        if f != math.Trunc(f) {
+            return reflect.Value{}, fmt.Errorf("cannot convert %v to %s without losing precision", f, t)
+        }
+        if f < 0 || f >= math.MaxUint64 || res.OverflowUint(uint64(f)) {
+            return reflect.Value{}, fmt.Errorf("%v overflows %s", f, t)
+        }
+        res.SetUint(uint64(f))
+    default:
+        return reflect.Value{}, fmt.Errorf("cannot convert %v (%s) to %s", val.Interface(), val.Type(), t)
+    }
+    return res, nil
+}
+
+// convertFloat converts numeric val into floating point type t
+func convertFloat(val reflect.Value, t reflect.Type) (reflect.Value, error) {
+    res := reflect.New(t).Elem()
+    var f float64
+    switch val.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        f = float64(val.Int())
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        f = float64(val.Uint())
+    case reflect.Float32, reflect.Float64:
+        f = val.Float()
+    default:
+        return reflect.Value{}, fmt.Errorf("cannot convert %v (%s) to %s", val.Interface(), val.Type(), t)
+    }
+    if !math.IsInf(f, 0) && res.OverflowFloat(f) {
+        return reflect.Value{}, fmt.Errorf("%v overflows %s", f, t)
+    }
+    res.SetFloat(f)
+    return res, nil
+}
+
+// convertTime converts ISO8601 string or unix timestamp into time.Time
+func convertTime(arg interface{}) (reflect.Value, error) {
+    switch v := arg.(type) {
+    case time.Time:
+        return reflect.ValueOf(v), nil
+    case string:
+        for _, layout := range timeLayouts {
+            if t, err := time.Parse(layout, v); err == nil {
+                return reflect.ValueOf(t), nil
+            }
+        }
+        return reflect.Value{}, fmt.Errorf("cannot parse %q as time", v)
+    }
+    f, err := convertFloat(reflect.ValueOf(arg), reflect.TypeOf(float64(0)))
+    if err != nil {
+        return reflect.Value{}, fmt.Errorf("cannot convert %v (%T) to time.Time", arg, arg)
+    }
+    sec, frac := math.Modf(f.Float())
+    return reflect.ValueOf(time.Unix(int64(sec), int64(frac*1e9)).UTC()), nil
+}
+
+// convertMapKey converts map key into type t, json object keys are always strings
+func convertMapKey(key interface{}, t reflect.Type) (reflect.Value, error) {
+    s, ok := key.(string)
+    if !ok {
+        return ConvertArg(key, t)
+    }
+    switch t.Kind() {
+    case reflect.String:
+        return reflect.ValueOf(s).Convert(t), nil
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        n, err := strconv.ParseInt(s, 10, 64)
+        if err != nil {
+            return reflect.Value{}, fmt.Errorf("cannot use key %q as %s", s, t)
+        }
+        return convertInt(reflect.ValueOf(n), t)
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        n, err := strconv.ParseUint(s, 10, 64)
+        if err != nil {
+            return reflect.Value{}, fmt.Errorf("cannot use key %q as %s", s, t)
+        }
+        return convertUint(reflect.ValueOf(n), t)
+    }
+    return ConvertArg(key, t)
+}
+
+// setStructFields sets fields of struct s from map m by json field names
+// Keys are matched case-insensitively as encoding/json does, unknown keys are ignored.
+func setStructFields(s reflect.Value, m reflect.Value) error {
+    t := s.Type()
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        tag := field.Tag.Get("json")
+        name := strings.Split(tag, ",")[0]
+        if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+            if err := setStructFields(s.Field(i), m); err != nil {
+                return err
+            }
+            continue
+        }
+        if field.PkgPath != "" || name == "-" {
+            continue
+        }
+        if name == "" {
+            name = field.Name
+        }
+        value, ok := mapValue(m, name)
+        if !ok {
+            continue
+        }
+        converted, err := ConvertArg(value, field.Type)
+        if err != nil {
+            return fmt.Errorf("field %s: %v", name, err)
+        }
+        s.Field(i).Set(converted)
+    }
+    return nil
+}
+
+// mapValue looks up key in map m, falling back to case-insensitive match
+func mapValue(m reflect.Value, key string) (interface{}, bool) {
+    var found interface{}
+    ok := false
+    iter := m.MapRange()
+    for iter.Next() {
+        k, isString := iter.Key().Interface().(string)
+        if !isString {
+            continue
+        }
+        if k == key {
+            return iter.Value().Interface(), true
+        }
+        if !ok && strings.EqualFold(k, key) {
+            found, ok = iter.Value().Interface(), true
+        }
     }
+    return found, ok
 }
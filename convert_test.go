@@ -0,0 +1,107 @@
+package gocelery
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type convertPoint struct {
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+	Label string `json:"label,omitempty"`
+	Skip  string `json:"-"`
+}
+
+func TestConvertArg(t *testing.T) {
+	when := time.Date(2019, 2, 16, 10, 52, 44, 123456000, time.UTC)
+	label := "origin"
+	cases := []struct {
+		arg      interface{}
+		expected interface{}
+	}{
+		{float64(42), int64(42)},
+		{float64(42), uint8(42)},
+		{float64(1.5), float32(1.5)},
+		{int8(-3), int(-3)},
+		{[]interface{}{"a", "b"}, []string{"a", "b"}},
+		{[]interface{}{float64(1), float64(2)}, [2]uint{1, 2}},
+		{map[string]interface{}{"a": float64(1)}, map[string]int{"a": 1}},
+		{map[string]interface{}{"7": "seven"}, map[int]string{7: "seven"}},
+		{"2019-02-16T10:52:44.123456+00:00", when},
+		{"2019-02-16T10:52:44.123456", when},
+		{"origin", &label},
+		{nil, []int(nil)},
+		{map[string]interface{}{"x": float64(1), "Y": float64(2), "Skip": "no"}, convertPoint{X: 1, Y: 2}},
+		{[]interface{}{map[string]interface{}{"x": float64(3)}}, []*convertPoint{{X: 3}}},
+	}
+	for _, c := range cases {
+		val, err := ConvertArg(c.arg, reflect.TypeOf(c.expected))
+		if err != nil {
+			t.Errorf("failed to convert %v to %T: %v", c.arg, c.expected, err)
+			continue
+		}
+		if expected, ok := c.expected.(time.Time); ok {
+			if !expected.Equal(val.Interface().(time.Time)) {
+				t.Errorf("converted %v to %v, expected %v", c.arg, val.Interface(), expected)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(val.Interface(), c.expected) {
+			t.Errorf("converted %v to %#v, expected %#v", c.arg, val.Interface(), c.expected)
+		}
+	}
+}
+
+func TestConvertArgErrors(t *testing.T) {
+	cases := []struct {
+		arg    interface{}
+		target interface{}
+	}{
+		{float64(300), int8(0)},
+		{float64(-1), uint(0)},
+		{float64(1.5), int(0)},
+		{float64(1e39), float32(0)},
+		{"1", int(0)},
+		{nil, int(0)},
+		{[]interface{}{"a", float64(1)}, []string{}},
+		{[]interface{}{float64(1)}, [2]int{}},
+		{map[string]interface{}{"x": "1"}, convertPoint{}},
+		{"yesterday", time.Time{}},
+	}
+	for _, c := range cases {
+		if val, err := ConvertArg(c.arg, reflect.TypeOf(c.target)); err == nil {
+			t.Errorf("converted %v to %T without error: %v", c.arg, c.target, val.Interface())
+		}
+	}
+}
+
+func TestRunTaskConvertArgs(t *testing.T) {
+	celeryWorker := NewCeleryWorker(nil, nil, 1)
+	celeryWorker.Register("sum", func(scale float32, values ...uint16) float32 {
+		var sum float32
+		for _, v := range values {
+			sum += float32(v)
+		}
+		return sum * scale
+	})
+	resultMsg, err := celeryWorker.RunTask(&CeleryTask{
+		Id:   generateUUID(),
+		Task: "sum",
+		Args: []interface{}{float64(0.5), float64(1), float64(2), float64(3)},
+	})
+	if err != nil {
+		t.Fatalf("failed to run task: %v", err)
+	}
+	if resultMsg.Result != float64(3) {
+		t.Errorf("unexpected result %v", resultMsg.Result)
+	}
+	_, err = celeryWorker.RunTask(&CeleryTask{
+		Id:   generateUUID(),
+		Task: "sum",
+		Args: []interface{}{float64(0.5), float64(-1)},
+	})
+	if err == nil {
+		t.Errorf("invalid variadic argument was accepted")
+	}
+}
@@ -0,0 +1,123 @@
+package gocelery
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Encryptor encrypts serialized message bodies and results
+type Encryptor interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// encryptorRegistry keeps encryptors by name, the name is sent in encryption header of messages
+var encryptorRegistry = struct {
+	sync.RWMutex
+	byName map[string]Encryptor
+}{
+	byName: make(map[string]Encryptor),
+}
+
+// RegisterEncryptor registers encryptor by name, replacing any encryptor previously registered with the same name
+// Producers and consumers of encrypted messages must register it with the same name.
+func RegisterEncryptor(name string, encryptor Encryptor) {
+	encryptorRegistry.Lock()
+	defer encryptorRegistry.Unlock()
+	encryptorRegistry.byName[name] = encryptor
+}
+
+// GetEncryptor retrieves registered encryptor by name
+func GetEncryptor(name string) (Encryptor, error) {
+	encryptorRegistry.RLock()
+	defer encryptorRegistry.RUnlock()
+	if encryptor, ok := encryptorRegistry.byName[name]; ok {
+		return encryptor, nil
+	}
+	return nil, fmt.Errorf("unsupported encryption %s", name)
+}
+
+// aesGCMMagic starts every AES-GCM envelope
+var aesGCMMagic = []byte("\x00GCM")
+
+// AESGCMEncryptor encrypts payloads with AES-GCM
+// Envelope is magic, key id length, key id, nonce and sealed payload,
+// magic and key id are authenticated as additional data.
+// Payloads are encrypted with the primary key and decrypted with the key of their id,
+// so keys can be rotated by adding a new primary key and keeping the old ones until
+// messages and results encrypted with them have expired.
+type AESGCMEncryptor struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewAESGCMEncryptor creates AESGCMEncryptor from 16, 24 or 32 bytes keys by their ids
+func NewAESGCMEncryptor(primaryKeyID string, keys map[string][]byte) (*AESGCMEncryptor, error) {
+	if _, ok := keys[primaryKeyID]; !ok {
+		return nil, fmt.Errorf("primary key %s is missing", primaryKeyID)
+	}
+	encryptor := &AESGCMEncryptor{
+		primary: primaryKeyID,
+		keys:    make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, fmt.Errorf("key id must have 1 to 255 bytes: %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		encryptor.keys[id] = aead
+	}
+	return encryptor, nil
+}
+
+func (e *AESGCMEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	aead := e.keys[e.primary]
+	header := make([]byte, 0, len(aesGCMMagic)+1+len(e.primary))
+	header = append(header, aesGCMMagic...)
+	header = append(header, byte(len(e.primary)))
+	header = append(header, e.primary...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	envelope := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	envelope = append(envelope, header...)
+	envelope = append(envelope, nonce...)
+	return aead.Seal(envelope, nonce, plaintext, header), nil
+}
+
+func (e *AESGCMEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	if !bytes.HasPrefix(ciphertext, aesGCMMagic) || len(ciphertext) <= len(aesGCMMagic) {
+		return nil, fmt.Errorf("payload is not encrypted with AES-GCM")
+	}
+	idEnd := len(aesGCMMagic) + 1 + int(ciphertext[len(aesGCMMagic)])
+	if idEnd > len(ciphertext) {
+		return nil, fmt.Errorf("malformed AES-GCM envelope")
+	}
+	id := string(ciphertext[len(aesGCMMagic)+1 : idEnd])
+	aead, ok := e.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", id)
+	}
+	if len(ciphertext) < idEnd+aead.NonceSize() {
+		return nil, fmt.Errorf("malformed AES-GCM envelope")
+	}
+	nonce := ciphertext[idEnd : idEnd+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[idEnd+aead.NonceSize():], ciphertext[:idEnd])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %s: %v", id, err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,96 @@
+package gocelery
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestAESGCMEncryptor(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	oldEncryptor, err := NewAESGCMEncryptor("2019-01", map[string][]byte{"2019-01": oldKey})
+	if err != nil {
+		t.Fatalf("failed to create encryptor: %v", err)
+	}
+	rotated, err := NewAESGCMEncryptor("2019-02", map[string][]byte{"2019-01": oldKey, "2019-02": newKey})
+	if err != nil {
+		t.Fatalf("failed to create encryptor: %v", err)
+	}
+	secret := []byte(`{"email": "user@example.com"}`)
+	encrypted, err := oldEncryptor.Encrypt(secret)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	if bytes.Contains(encrypted, secret) {
+		t.Errorf("payload was not encrypted")
+	}
+	if decrypted, err := rotated.Decrypt(encrypted); err != nil || !bytes.Equal(decrypted, secret) {
+		t.Errorf("failed to decrypt with rotated keys: %q %v", decrypted, err)
+	}
+	encrypted, _ = rotated.Encrypt(secret)
+	if _, err := oldEncryptor.Decrypt(encrypted); err == nil {
+		t.Errorf("payload encrypted with unknown key was decrypted")
+	}
+	encrypted[len(encrypted)-1] ^= 1
+	if _, err := rotated.Decrypt(encrypted); err == nil {
+		t.Errorf("tampered payload was decrypted")
+	}
+	if _, err := rotated.Decrypt(secret); err == nil {
+		t.Errorf("plain payload was decrypted")
+	}
+	if _, err := NewAESGCMEncryptor("missing", map[string][]byte{"2019-01": oldKey}); err == nil {
+		t.Errorf("missing primary key was accepted")
+	}
+	if _, err := NewAESGCMEncryptor("short", map[string][]byte{"short": []byte("short")}); err == nil {
+		t.Errorf("invalid key size was accepted")
+	}
+}
+
+func TestEncryptedMessage(t *testing.T) {
+	encryptor, _ := NewAESGCMEncryptor("k1", map[string][]byte{"k1": bytes.Repeat([]byte{3}, 32)})
+	RegisterEncryptor("test-aes", encryptor)
+	broker := &memoryBroker{}
+	client, err := NewCeleryClient(broker, nil, ClientEncryption("test-aes"), ClientCompression("zlib"))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if _, err := client.Delay("notify", "user@example.com"); err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	msg := broker.messages[0]
+	if msg.Headers.Encryption != "test-aes" {
+		t.Errorf("unexpected encryption header %s", msg.Headers.Encryption)
+	}
+	if strings.Contains(msg.Headers.ArgsRepr+msg.Headers.KwargsRepr, "user@example.com") {
+		t.Errorf("arguments of encrypted task sent in clear: %s %s", msg.Headers.ArgsRepr, msg.Headers.KwargsRepr)
+	}
+	data, _ := base64.StdEncoding.DecodeString(msg.Body)
+	if !bytes.HasPrefix(data, aesGCMMagic) {
+		t.Errorf("body was not encrypted")
+	}
+	task, _ := broker.GetTask()
+	if task == nil || len(task.Args) != 1 || task.Args[0] != "user@example.com" {
+		t.Fatalf("failed to decrypt task: %v", task)
+	}
+	if _, err := NewCeleryClient(broker, nil, ClientEncryption("unknown")); err == nil {
+		t.Errorf("unsupported encryption was accepted")
+	}
+}
+
+func TestEncryptedResult(t *testing.T) {
+	encryptor, _ := NewAESGCMEncryptor("k1", map[string][]byte{"k1": bytes.Repeat([]byte{4}, 32)})
+	RegisterEncryptor("test-results", encryptor)
+	options := newBackendOptions([]BackendOptions{BackendEncryption("test-results"), BackendSerializer("msgpack")})
+	serializer, data, err := options.encodeResult(&ResultMessage{ID: "id", Status: StateSuccess, Result: "secret"})
+	if err != nil {
+		t.Fatalf("failed to encode result: %v", err)
+	}
+	if serializer.ContentType() != "application/x-msgpack" || bytes.Contains(data, []byte("secret")) {
+		t.Errorf("result was not encrypted")
+	}
+	result, err := options.decodeResult(data, options.Serializer, options.Encryption)
+	if err != nil || result.Result != "secret" {
+		t.Errorf("failed to decode result: %v %v", result, err)
+	}
+}
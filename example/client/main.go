@@ -56,8 +56,8 @@ func main() {
     celeryBackend := gocelery.NewRedisCeleryBackend(redisHost, redisPort, 0, redisPassword)
 
     // AMQP example
-    // celeryBroker := gocelery.NewAMQPCeleryBroker("amqp://")
-    // celeryBackend := gocelery.NewAMQPCeleryBackend("amqp://")
+    // celeryBroker, _ := gocelery.NewAMQPCeleryBroker("amqp://")
+    // celeryBackend, _ := gocelery.NewAMQPCeleryBackend("amqp://")
 
     // create client
     celeryClient, _ := gocelery.NewCeleryClient(celeryBroker, celeryBackend)
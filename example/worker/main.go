@@ -53,8 +53,8 @@ func main() {
     celeryBackend := gocelery.NewRedisCeleryBackend("localhost", 6379, 0, "")
 
     // AMQP example
-    // celeryBroker := gocelery.NewAMQPCeleryBroker("amqp://")
-    // celeryBackend := gocelery.NewAMQPCeleryBackend("amqp://")
+    // celeryBroker, _ := gocelery.NewAMQPCeleryBroker("amqp://")
+    // celeryBackend, _ := gocelery.NewAMQPCeleryBackend("amqp://")
 
     // Configure with 2 celery workers
     celeryServer, _ := gocelery.NewCeleryServer(celeryBroker, celeryBackend, 2)
@@ -1,11 +1,22 @@
 module github.com/Danceiny/gocelery
 
+go 1.18
+
 require (
 	github.com/Danceiny/go.fastjson v0.0.0-20190216105244-da65d641a199
 	github.com/Danceiny/go.uuid v1.3.0
 	github.com/garyburd/redigo v1.6.0
 	github.com/streadway/amqp v0.0.0-20190214183023-884228600bc9
+)
+
+require (
+	github.com/json-iterator/go v1.1.5 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/sirupsen/logrus v1.3.0 // indirect
 	github.com/stretchr/testify v1.3.0 // indirect
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
 	golang.org/x/crypto v0.0.0-20190211182817-74369b46fc67 // indirect
 	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
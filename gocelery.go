@@ -1,10 +1,12 @@
 package gocelery
 
 import (
+    "errors"
     "fmt"
     "log"
     "os"
     "os/signal"
+    "path"
     "syscall"
     "time"
 )
@@ -17,8 +19,149 @@ type CeleryServer struct {
 }
 
 type CeleryClient struct {
-    broker  CeleryBroker
-    backend CeleryBackend
+    broker       CeleryBroker
+    backend      CeleryBackend
+    interceptors []PublishInterceptor
+    options      clientOptions
+}
+
+// ClientOptions configures CeleryClient
+type ClientOptions struct {
+    f func(*clientOptions)
+}
+
+type clientOptions struct {
+    Serializer  string
+    Compression string
+    Encryption  string
+    Protocol    int
+    // ReprMaxSize limits size of argsrepr and kwargsrepr headers
+    ReprMaxSize int
+    // RedactedKwargs are kwargs whose values are hidden in kwargsrepr header
+    RedactedKwargs []string
+    // Routes route tasks sent without exchange and routing key
+    Routes []TaskRoute
+}
+
+// TaskRoute routes tasks whose name matches Pattern, like task_routes of Celery
+// Pattern is matched by path.Match, e.g. "feed.tasks.*". Tasks are sent to Exchange
+// with RoutingKey, which is Queue by default, so that the default exchange delivers
+// them to Queue. Redis broker has no exchanges, it ignores Exchange and pushes tasks to list
+// named by RoutingKey.
+type TaskRoute struct {
+    Pattern    string
+    Queue      string
+    Exchange   string
+    RoutingKey string
+}
+
+// deliveryInfo returns delivery info of the route
+func (r TaskRoute) deliveryInfo() *CeleryDeliveryInfo {
+    routingKey := r.RoutingKey
+    if routingKey == "" {
+        routingKey = r.Queue
+    }
+    return NewCeleryDeliveryInfo(routingKey, r.Exchange)
+}
+
+// ClientSerializer sets name or content type of registered Serializer used for task bodies
+func ClientSerializer(serializer string) ClientOptions {
+    return ClientOptions{func(options *clientOptions) {
+        options.Serializer = serializer
+    }}
+}
+
+// ClientCompression sets name or content type of registered Compressor used for task bodies
+func ClientCompression(compression string) ClientOptions {
+    return ClientOptions{func(options *clientOptions) {
+        options.Compression = compression
+    }}
+}
+
+// ClientEncryption sets name of registered Encryptor used for task bodies
+func ClientEncryption(encryption string) ClientOptions {
+    return ClientOptions{func(options *clientOptions) {
+        options.Encryption = encryption
+    }}
+}
+
+// ClientProtocol sets version of message protocol, 2 by default
+// Protocol 1 is needed by Python workers older than Celery 3.1.24.
+func ClientProtocol(version int) ClientOptions {
+    return ClientOptions{func(options *clientOptions) {
+        options.Protocol = version
+    }}
+}
+
+// ClientReprMaxSize sets maximum size of argsrepr and kwargsrepr headers shown in logs and monitoring,
+// longer representations are truncated, 1024 by default and 0 for no limit
+func ClientReprMaxSize(size int) ClientOptions {
+    return ClientOptions{func(options *clientOptions) {
+        options.ReprMaxSize = size
+    }}
+}
+
+// ClientTaskRoutes adds routes of tasks, the first route matching task name is used
+func ClientTaskRoutes(routes ...TaskRoute) ClientOptions {
+    return ClientOptions{func(options *clientOptions) {
+        options.Routes = append(options.Routes, routes...)
+    }}
+}
+
+// ClientRedactKwargs hides values of kwargs with given names in kwargsrepr header, e.g. passwords
+func ClientRedactKwargs(names ...string) ClientOptions {
+    return ClientOptions{func(options *clientOptions) {
+        options.RedactedKwargs = append(options.RedactedKwargs, names...)
+    }}
+}
+
+// ApplyOptions configures a single ApplyAsync call, overriding client defaults
+type ApplyOptions struct {
+    f func(*CeleryTask)
+}
+
+// ApplySerializer sets name or content type of registered Serializer used for task body
+func ApplySerializer(serializer string) ApplyOptions {
+    return ApplyOptions{func(task *CeleryTask) {
+        task.Serializer = serializer
+    }}
+}
+
+// ApplyCompression sets name or content type of registered Compressor used for task body
+func ApplyCompression(compression string) ApplyOptions {
+    return ApplyOptions{func(task *CeleryTask) {
+        task.Compression = compression
+    }}
+}
+
+// ApplyEncryption sets name of registered Encryptor used for task body
+func ApplyEncryption(encryption string) ApplyOptions {
+    return ApplyOptions{func(task *CeleryTask) {
+        task.Encryption = encryption
+    }}
+}
+
+// ApplyShadow sets task name shown in logs and monitoring instead of the real one
+func ApplyShadow(name string) ApplyOptions {
+    return ApplyOptions{func(task *CeleryTask) {
+        task.Shadow = name
+    }}
+}
+
+// ApplyTimeLimit sets hard and soft time limits of the task, zero means no limit
+func ApplyTimeLimit(hard, soft time.Duration) ApplyOptions {
+    return ApplyOptions{func(task *CeleryTask) {
+        task.TimeLimit = hard
+        task.SoftTimeLimit = soft
+    }}
+}
+
+// ApplyArgsRepr overrides argsrepr and kwargsrepr headers, e.g. to hide sensitive arguments
+func ApplyArgsRepr(argsRepr, kwargsRepr string) ApplyOptions {
+    return ApplyOptions{func(task *CeleryTask) {
+        task.ArgsRepr = argsRepr
+        task.KwargsRepr = kwargsRepr
+    }}
 }
 
 // CeleryBroker is interface for celery broker database
@@ -27,24 +170,190 @@ type CeleryBroker interface {
     GetTask() (*CeleryTask, error) // must be non-blocking
 }
 
+// PrefetchingBroker is CeleryBroker prefetching tasks, the worker sets number of its goroutines
+// when it starts so that enough tasks are prefetched for all of them. Tasks acknowledged late
+// which the worker holds until their ETA are passed to HoldTasks, widening prefetch window by
+// delta while they are held, so that they do not stop the worker from receiving other tasks.
+type PrefetchingBroker interface {
+    CeleryBroker
+    SetConcurrency(concurrency int) error
+    HoldTasks(delta int) error
+}
+
+// TaskAcknowledger acknowledges message of task received from broker acknowledging tasks late,
+// the worker acknowledges or rejects it when the task is done
+type TaskAcknowledger interface {
+    Ack() error
+    // Reject rejects message, which is requeued or dropped, i.e. dead-lettered
+    Reject(requeue bool) error
+}
+
 // CeleryBackend is interface for celery backend database
 type CeleryBackend interface {
     GetResult(string) (*ResultMessage, error) // must be non-blocking
     SetResult(taskID string, result *ResultMessage) error
 }
 
+// ReplyBackend is CeleryBackend sending results to queue of the client which sent the task,
+// like Celery rpc backend. Clients set reply_to of tasks and workers reply to it.
+type ReplyBackend interface {
+    CeleryBackend
+    // ReplyTo returns name of the queue results are sent to
+    ReplyTo() string
+    // SetTaskResult sends result of task received by worker to its reply_to
+    SetTaskResult(task *CeleryTask, result *ResultMessage) error
+}
+
+// NotifyingBackend is CeleryBackend notifying of stored results, AsyncResult.Get waits
+// for notifications instead of polling the backend
+type NotifyingBackend interface {
+    CeleryBackend
+    // WaitResult returns channel receiving a value when result of task may have changed,
+    // until cancel is called
+    WaitResult(taskID string) (notify <-chan struct{}, cancel func(), err error)
+}
+
+// setTaskResult stores result of task received by worker
+func setTaskResult(backend CeleryBackend, task *CeleryTask, result *ResultMessage) error {
+    if replyBackend, ok := backend.(ReplyBackend); ok {
+        return replyBackend.SetTaskResult(task, result)
+    }
+    return backend.SetResult(task.Id, result)
+}
+
+// ErrResultNotAvailable is returned when task has no result yet
+var ErrResultNotAvailable = errors.New("result not available")
+
+// BackendOptions configures result backends
+type BackendOptions struct {
+    f func(*backendOptions)
+}
+
+type backendOptions struct {
+    Serializer string
+    Encryption string
+    // ConnectionTimeout is used by AMQP backend only
+    ConnectionTimeout time.Duration
+}
+
+// BackendSerializer sets name or content type of registered Serializer used for results,
+// it must match result_serializer of Python workers and clients
+func BackendSerializer(serializer string) BackendOptions {
+    return BackendOptions{func(options *backendOptions) {
+        options.Serializer = serializer
+    }}
+}
+
+// BackendEncryption sets name of registered Encryptor used for results
+func BackendEncryption(encryption string) BackendOptions {
+    return BackendOptions{func(options *backendOptions) {
+        options.Encryption = encryption
+    }}
+}
+
+// BackendConnectionTimeout sets how long getting and setting results wait for lost connection
+// to be reestablished, 0 makes them fail immediately; used by AMQP backend
+func BackendConnectionTimeout(timeout time.Duration) BackendOptions {
+    return BackendOptions{func(options *backendOptions) {
+        options.ConnectionTimeout = timeout
+    }}
+}
+
+func newBackendOptions(options []BackendOptions) backendOptions {
+    do := backendOptions{ConnectionTimeout: defaultAMQPTimeout}
+    for _, opt := range options {
+        opt.f(&do)
+    }
+    return do
+}
+
+// encodeResult serializes and encrypts result according to backend options
+func (o backendOptions) encodeResult(result *ResultMessage) (Serializer, []byte, error) {
+    serializer, err := GetSerializer(o.Serializer)
+    if err != nil {
+        return nil, nil, err
+    }
+    data, err := serializer.Marshal(result)
+    if err != nil {
+        return nil, nil, err
+    }
+    if o.Encryption != "" {
+        encryptor, err := GetEncryptor(o.Encryption)
+        if err != nil {
+            return nil, nil, err
+        }
+        if data, err = encryptor.Encrypt(data); err != nil {
+            return nil, nil, err
+        }
+    }
+    return serializer, data, nil
+}
+
+// decodeResult decrypts and deserializes result, serializer and encryption default to backend options
+func (o backendOptions) decodeResult(data []byte, serializerName string, encryption string) (*ResultMessage, error) {
+    serializer, err := GetSerializer(serializerName)
+    if err != nil {
+        if serializer, err = GetSerializer(o.Serializer); err != nil {
+            return nil, err
+        }
+    }
+    if encryption != "" {
+        encryptor, err := GetEncryptor(encryption)
+        if err != nil {
+            return nil, err
+        }
+        if data, err = encryptor.Decrypt(data); err != nil {
+            return nil, err
+        }
+    }
+    var resultMessage ResultMessage
+    if err := serializer.Unmarshal(data, &resultMessage); err != nil {
+        return nil, err
+    }
+    return &resultMessage, nil
+}
+
 // NewCeleryClient creates new celery client
-func NewCeleryServer(broker CeleryBroker, backend CeleryBackend, numWorkers int) (*CeleryServer, error) {
+func NewCeleryServer(broker CeleryBroker, backend CeleryBackend, numWorkers int, options ...WorkerOptions) (*CeleryServer, error) {
     return &CeleryServer{
         broker,
         backend,
-        NewCeleryWorker(broker, backend, numWorkers),
+        NewCeleryWorker(broker, backend, numWorkers, options...),
     }, nil
 }
-func NewCeleryClient(broker CeleryBroker, backend CeleryBackend) (*CeleryClient, error) {
+func NewCeleryClient(broker CeleryBroker, backend CeleryBackend, options ...ClientOptions) (*CeleryClient, error) {
+    do := clientOptions{ReprMaxSize: defaultReprMaxSize}
+    for _, opt := range options {
+        opt.f(&do)
+    }
+    if _, err := GetSerializer(do.Serializer); err != nil {
+        return nil, err
+    }
+    if do.Compression != "" {
+        if _, err := GetCompressor(do.Compression); err != nil {
+            return nil, err
+        }
+    }
+    if do.Encryption != "" {
+        if _, err := GetEncryptor(do.Encryption); err != nil {
+            return nil, err
+        }
+    }
+    if do.Protocol != 0 && do.Protocol != 1 && do.Protocol != 2 {
+        return nil, fmt.Errorf("unsupported protocol version %d", do.Protocol)
+    }
+    for _, route := range do.Routes {
+        if _, err := path.Match(route.Pattern, ""); err != nil {
+            return nil, fmt.Errorf("bad route pattern %q: %v", route.Pattern, err)
+        }
+        if route.Queue == "" && route.RoutingKey == "" && route.Exchange == "" {
+            return nil, fmt.Errorf("route %q has no destination", route.Pattern)
+        }
+    }
     return &CeleryClient{
-        broker,
-        backend,
+        broker:  broker,
+        backend: backend,
+        options: do,
     }, nil
 }
 
@@ -53,6 +362,16 @@ func (cc *CeleryServer) Register(name string, task interface{}) {
     cc.worker.Register(name, task)
 }
 
+// RegisterWithParams registers function task with names of its parameters
+func (cc *CeleryServer) RegisterWithParams(name string, task interface{}, params ...string) error {
+    return cc.worker.RegisterWithParams(name, task, params...)
+}
+
+// Use adds task middlewares to the worker
+func (cc *CeleryServer) Use(middlewares ...TaskMiddleware) {
+    cc.worker.Use(middlewares...)
+}
+
 // StartWorker starts celery workers infinite loop
 func (cc *CeleryServer) StartWorker() {
     c := make(chan os.Signal)
@@ -71,6 +390,11 @@ func (cc *CeleryServer) StopWorker() {
     cc.worker.StopWorker()
 }
 
+// Use adds publish interceptors to the client, they are called in the order they were added
+func (cc *CeleryClient) Use(interceptors ...PublishInterceptor) {
+    cc.interceptors = append(cc.interceptors, interceptors...)
+}
+
 // Delay gets asynchronous result
 func (cc *CeleryClient) Delay(task string, args ...interface{}) (*AsyncResult, error) {
     celeryTask := getTaskObj(task)
@@ -86,7 +410,7 @@ func (cc *CeleryClient) DelayKwargs(task string, args map[string]interface{}) (*
 }
 func (cc *CeleryClient) ApplyAsync(task string, args []interface{}, kwargs map[string]interface{},
     expires *time.Time, eta *time.Time, retry bool, queue string,
-    priority int, routingKey string, exchange string) (*AsyncResult, error) {
+    priority int, routingKey string, exchange string, options ...ApplyOptions) (*AsyncResult, error) {
     celeryTask := getTaskObj(task)
     if kwargs != nil {
         celeryTask.Kwargs = kwargs
@@ -101,6 +425,16 @@ func (cc *CeleryClient) ApplyAsync(task string, args []interface{}, kwargs map[s
         celeryTask.Expires = *expires
     }
     celeryTask.Priority = priority
+    for _, opt := range options {
+        opt.f(celeryTask)
+    }
+    if routingKey == "" {
+        routingKey = queue
+    }
+    if routingKey == "" && exchange == "" {
+        // routed by client routes
+        return cc.delay(celeryTask, nil)
+    }
     return cc.delay(celeryTask, NewCeleryDeliveryInfo(routingKey, exchange))
 
     /*
@@ -193,9 +527,33 @@ func (cc *CeleryClient) ApplyAsync(task string, args []interface{}, kwargs map[s
 }
 func (cc *CeleryClient) delay(task *CeleryTask, info *CeleryDeliveryInfo) (*AsyncResult, error) {
     defer releaseTaskMessage(task)
-    celeryMessage := Task2Msg(task)
+    if task.Serializer == "" {
+        task.Serializer = cc.options.Serializer
+    }
+    if task.Compression == "" {
+        task.Compression = cc.options.Compression
+    }
+    if task.Encryption == "" {
+        task.Encryption = cc.options.Encryption
+    }
+    if task.Protocol == 0 {
+        task.Protocol = cc.options.Protocol
+    }
+    if replyBackend, ok := cc.backend.(ReplyBackend); ok && task.ReplyTo == "" {
+        task.ReplyTo = replyBackend.ReplyTo()
+    }
+    celeryMessage := task2Headers(task)
     defer releaseCeleryMessage(celeryMessage)
-    err := cc.broker.SendCeleryMessage(celeryMessage)
+    if info == nil {
+        info = cc.route(task.Task)
+    }
+    if info != nil {
+        celeryMessage.Properties.DeliveryInfo = *info
+    } else {
+        // brokers send it to their default queue
+        celeryMessage.Properties.DeliveryInfo = CeleryDeliveryInfo{}
+    }
+    err := chainPublishInterceptors(cc.interceptors, cc.publish)(task, celeryMessage)
     if err != nil {
         return nil, err
     }
@@ -205,6 +563,25 @@ func (cc *CeleryClient) delay(task *CeleryTask, info *CeleryDeliveryInfo) (*Asyn
     }, nil
 }
 
+// route returns delivery info of the first route matching task name, nil if there is none
+func (cc *CeleryClient) route(task string) *CeleryDeliveryInfo {
+    for _, route := range cc.options.Routes {
+        if ok, _ := path.Match(route.Pattern, task); ok {
+            return route.deliveryInfo()
+        }
+    }
+    return nil
+}
+
+// publish renders repr headers, encodes task body and sends message to broker
+func (cc *CeleryClient) publish(task *CeleryTask, message *CeleryMessage) error {
+    setReprHeaders(task, message, cc.options.RedactedKwargs, cc.options.ReprMaxSize)
+    if err := encodeMessageBody(task, message); err != nil {
+        return err
+    }
+    return cc.broker.SendCeleryMessage(message)
+}
+
 // Itf_CeleryTask is an interface that represents actual task
 // Passing Itf_CeleryTask interface instead of function pointer
 // avoids reflection and may have performance gain.
@@ -230,53 +607,104 @@ func (ar *AsyncResult) GetTaskId() string {
 
 // Get gets actual result from redis
 // It blocks for period of time set by timeout and return error if unavailable
+// or if the task failed. It polls the backend unless it is NotifyingBackend.
 func (ar *AsyncResult) Get(timeout time.Duration) (interface{}, error) {
-    ticker := time.NewTicker(50 * time.Millisecond)
+    interval := 50 * time.Millisecond
+    var notify <-chan struct{}
+    if backend, ok := ar.backend.(NotifyingBackend); ok && ar.result == nil {
+        wait, cancel, err := backend.WaitResult(ar.taskID)
+        if err == nil {
+            defer cancel()
+            notify = wait
+            // poll rarely in case notification is lost
+            interval = time.Second
+        }
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
     timeoutChan := time.After(timeout)
     for {
+        val, err := ar.AsyncGet()
+        if err == nil {
+            return val, nil
+        }
+        if ar.result != nil {
+            // the task failed
+            return nil, err
+        }
         select {
         case <-timeoutChan:
             err := fmt.Errorf("%v timeout getting result for %s", timeout, ar.taskID)
             return nil, err
         case <-ticker.C:
-            val, err := ar.AsyncGet()
-            if err != nil {
-                continue
-            }
-            return val, nil
+        case <-notify:
         }
     }
 }
 
-// AsyncGet gets actual result from redis and returns nil if not available
+// AsyncGet gets actual result from redis and returns ErrResultNotAvailable
+// if the task has not finished yet
 func (ar *AsyncResult) AsyncGet() (interface{}, error) {
-    if ar.result != nil {
-        return ar.result.Result, nil
-    }
-    // process
-    val, err := ar.backend.GetResult(ar.taskID)
+    val, err := ar.fetch()
     if err != nil {
         return nil, err
     }
-    if val == nil {
-        return nil, err
+    if val == nil || !isReadyState(val.Status) {
+        return nil, ErrResultNotAvailable
     }
-    if val.Status != "SUCCESS" {
-        return nil, fmt.Errorf("error response status %v", val)
+    if val.Status != StateSuccess {
+        return nil, resultError(val)
     }
-    ar.result = val
     return val.Result, nil
 }
 
-// Ready checks if actual result is ready
+// Ready checks if the task has finished, either successfully or not
 func (ar *AsyncResult) Ready() (bool, error) {
+    val, err := ar.fetch()
+    if err != nil {
+        return false, err
+    }
+    return val != nil && isReadyState(val.Status), nil
+}
+
+// State returns current state of the task, PENDING if it is unknown,
+// or a custom state stored by TaskContext.UpdateState like Celery update_state
+func (ar *AsyncResult) State() (string, error) {
+    val, err := ar.fetch()
+    if err != nil {
+        return "", err
+    }
+    if val == nil {
+        return StatePending, nil
+    }
+    return val.Status, nil
+}
+
+// Info returns value stored with current state of the task: result if it succeeded,
+// exception if it failed or meta of a custom state, nil if it is pending
+func (ar *AsyncResult) Info() (interface{}, error) {
+    val, err := ar.fetch()
+    if err != nil || val == nil {
+        return nil, err
+    }
+    return val.Result, nil
+}
+
+// fetch gets latest result of the task from backend, nil if there is none yet
+// Results of finished tasks are kept, as they do not change anymore.
+func (ar *AsyncResult) fetch() (*ResultMessage, error) {
     if ar.result != nil {
-        return true, nil
+        return ar.result, nil
     }
     val, err := ar.backend.GetResult(ar.taskID)
+    if err == ErrResultNotAvailable {
+        return nil, nil
+    }
     if err != nil {
-        return false, err
+        return nil, err
+    }
+    if val != nil && isReadyState(val.Status) {
+        ar.result = val
     }
-    ar.result = val
-    return (val != nil), nil
+    return val, nil
 }
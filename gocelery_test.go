@@ -45,8 +45,14 @@ func (m *multiplyKwargs) RunTask() (interface{}, error) {
 }
 
 func getAMQPClient() (*CeleryClient, error) {
-    amqpBroker := NewAMQPCeleryBroker("amqp://")
-    amqpBackend := NewAMQPCeleryBackend("amqp://")
+    amqpBroker, err := NewAMQPCeleryBroker("amqp://")
+    if err != nil {
+        return nil, err
+    }
+    amqpBackend, err := NewAMQPCeleryBackend("amqp://")
+    if err != nil {
+        return nil, err
+    }
     return NewCeleryClient(amqpBroker, amqpBackend)
 }
 
@@ -212,3 +218,37 @@ func TestBlockingGet(t *testing.T) {
 	}
 }
 */
+
+func TestTaskRoutes(t *testing.T) {
+    broker := &memoryBroker{}
+    client, err := NewCeleryClient(broker, nil, ClientTaskRoutes(
+        TaskRoute{Pattern: "feed.tasks.*", Queue: "feeds"},
+        TaskRoute{Pattern: "video.*", Exchange: "media", RoutingKey: "media.video"},
+    ))
+    if err != nil {
+        t.Fatalf("failed to create client: %v", err)
+    }
+    client.Delay("feed.tasks.import_feed")
+    client.Delay("video.compress")
+    client.Delay("add")
+    client.ApplyAsync("feed.tasks.import_feed", nil, nil, nil, nil, false, "priority", 0, "", "")
+    client.ApplyAsync("add", nil, nil, nil, nil, false, "", 0, "stock.nasdaq", "stocks")
+    expected := []CeleryDeliveryInfo{
+        {RoutingKey: "feeds", Exchange: ""},
+        {RoutingKey: "media.video", Exchange: "media"},
+        {RoutingKey: "celery", Exchange: ""},
+        {RoutingKey: "priority", Exchange: ""},
+        {RoutingKey: "stock.nasdaq", Exchange: "stocks"},
+    }
+    if len(broker.messages) != len(expected) {
+        t.Fatalf("%d tasks sent instead of %d", len(broker.messages), len(expected))
+    }
+    for i, message := range broker.messages {
+        if message.Properties.DeliveryInfo != expected[i] {
+            t.Errorf("task %s sent with %v instead of %v", message.Headers.Task, message.Properties.DeliveryInfo, expected[i])
+        }
+    }
+    if _, err := NewCeleryClient(broker, nil, ClientTaskRoutes(TaskRoute{Pattern: "[", Queue: "q"})); err == nil {
+        t.Errorf("bad route pattern must be rejected")
+    }
+}
@@ -0,0 +1,41 @@
+package gocelery
+
+// PublishHandler publishes a task message to the broker
+type PublishHandler func(task *CeleryTask, message *CeleryMessage) error
+
+// PublishInterceptor intercepts task publishing on the client side, similar to gRPC client interceptors.
+// message carries headers and properties built from task, its body is encoded from task by the
+// final handler, so interceptors may modify both task arguments and message headers.
+// An interceptor must call next to continue publishing, or return an error to abort it.
+type PublishInterceptor func(task *CeleryTask, message *CeleryMessage, next PublishHandler) error
+
+// TaskHandler executes a task and returns its result
+type TaskHandler func(task *CeleryTask) (*ResultMessage, error)
+
+// TaskMiddleware wraps task execution on the worker side, similar to gRPC server interceptors.
+// It may inspect or modify task before calling next and the ResultMessage returned by next.
+type TaskMiddleware func(task *CeleryTask, next TaskHandler) (*ResultMessage, error)
+
+// chainPublishInterceptors builds a PublishHandler calling interceptors in order and final last
+func chainPublishInterceptors(interceptors []PublishInterceptor, final PublishHandler) PublishHandler {
+	handler := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(task *CeleryTask, message *CeleryMessage) error {
+			return interceptor(task, message, next)
+		}
+	}
+	return handler
+}
+
+// chainTaskMiddlewares builds a TaskHandler calling middlewares in order and final last
+func chainTaskMiddlewares(middlewares []TaskMiddleware, final TaskHandler) TaskHandler {
+	handler := final
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		middleware, next := middlewares[i], handler
+		handler = func(task *CeleryTask) (*ResultMessage, error) {
+			return middleware(task, next)
+		}
+	}
+	return handler
+}
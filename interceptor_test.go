@@ -0,0 +1,108 @@
+package gocelery
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// memoryBroker is in-memory CeleryBroker for testing
+type memoryBroker struct {
+	messages []*CeleryMessage
+}
+
+func (b *memoryBroker) SendCeleryMessage(message *CeleryMessage) error {
+	// message is released by client after sending
+	copied := *message
+	if copied.Properties.DeliveryInfo == (CeleryDeliveryInfo{}) {
+		copied.Properties.DeliveryInfo.RoutingKey = "celery"
+	}
+	b.messages = append(b.messages, &copied)
+	return nil
+}
+
+func (b *memoryBroker) GetTask() (*CeleryTask, error) {
+	if len(b.messages) == 0 {
+		return nil, fmt.Errorf("no message available")
+	}
+	message := b.messages[0]
+	b.messages = b.messages[1:]
+	return Msg2Task(message), nil
+}
+
+func TestPublishInterceptors(t *testing.T) {
+	broker := &memoryBroker{}
+	client, _ := NewCeleryClient(broker, nil)
+	var order []string
+	client.Use(func(task *CeleryTask, message *CeleryMessage, next PublishHandler) error {
+		order = append(order, "first")
+		task.Args = append(task.Args, 3)
+		message.Headers.Extra = map[string]interface{}{"tenant_id": "acme"}
+		return next(task, message)
+	}, func(task *CeleryTask, message *CeleryMessage, next PublishHandler) error {
+		order = append(order, "second")
+		return next(task, message)
+	})
+	if _, err := client.Delay("add", 1, 2); err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	if !reflect.DeepEqual(order, []string{"first", "second"}) {
+		t.Errorf("interceptors called in wrong order: %v", order)
+	}
+	task, err := broker.GetTask()
+	if err != nil || task == nil {
+		t.Fatalf("failed to get task: %v", err)
+	}
+	if len(task.Args) != 3 {
+		t.Errorf("modified args %v were not encoded", task.Args)
+	}
+	if task.Headers["tenant_id"] != "acme" {
+		t.Errorf("custom header was not sent: %v", task.Headers)
+	}
+}
+
+func TestPublishInterceptorAbort(t *testing.T) {
+	broker := &memoryBroker{}
+	client, _ := NewCeleryClient(broker, nil)
+	client.Use(func(task *CeleryTask, message *CeleryMessage, next PublishHandler) error {
+		return fmt.Errorf("unauthorized")
+	})
+	if _, err := client.Delay("add", 1, 2); err == nil {
+		t.Errorf("interceptor error was not returned")
+	}
+	if len(broker.messages) != 0 {
+		t.Errorf("aborted task was sent to broker")
+	}
+}
+
+func TestTaskMiddlewares(t *testing.T) {
+	celeryWorker := newCeleryWorker(1)
+	taskName := registerTask(celeryWorker)
+	var order []string
+	celeryWorker.Use(func(task *CeleryTask, next TaskHandler) (*ResultMessage, error) {
+		order = append(order, "first")
+		task.Args[0] = 10
+		return next(task)
+	}, func(task *CeleryTask, next TaskHandler) (*ResultMessage, error) {
+		order = append(order, "second")
+		result, err := next(task)
+		if err == nil {
+			result.Result = result.Result.(int64) * 2
+		}
+		return result, err
+	})
+	resultMsg, err := celeryWorker.RunTask(&CeleryTask{
+		Id:   generateUUID(),
+		Task: taskName,
+		Args: []interface{}{1, 2},
+	})
+	if err != nil {
+		t.Fatalf("failed to run task: %v", err)
+	}
+	if !reflect.DeepEqual(order, []string{"first", "second"}) {
+		t.Errorf("middlewares called in wrong order: %v", order)
+	}
+	if resultMsg.Result != int64(24) {
+		t.Errorf("unexpected result %v", resultMsg.Result)
+	}
+}
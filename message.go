@@ -6,6 +6,7 @@ import (
 	"github.com/Danceiny/go.fastjson"
 	"log"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 )
@@ -89,14 +90,14 @@ type ST_Properties struct {
 	// ContentEncoding string `json:"content_encoding"` // 事实上该字段移动到与properties并列的层级了
 	// ContentType     string `json:"content_type"`     // 事实上该字段移动到与properties并列的层级了
 	CorrelationID string `json:"correlation_id"`
-	ReplyTo       string `json:"replay_to"`
+	// ReplyTo is the queue results are sent to by rpc backends
+	ReplyTo string `json:"reply_to"`
 	// 下面的在Celery文档中未曾提及
 	BodyEncoding  string             `json:"body_encoding"`
 	Priority      int                `json:"priority"`
 	DeliveryInfo  CeleryDeliveryInfo `json:"delivery_info"`
 	DeliveryMode  int                `json:"delivery_mode"`
 	DeliveryTag   string             `json:"delivery_tag"`
-	CorrelationId string             `json:"correlation_id"`
 }
 
 /*
@@ -132,16 +133,115 @@ type ST_Headers struct {
 	Shadow     string    `json:"shadow"` // alias_name, optional
 	ArgsRepr   string    `json:"argsrepr"`
 	KwargsRepr string    `json:"kwargsrepr"`
-	TimeLimit  [2]string `json:"timelimit"`
+	// TimeLimit is [hard, soft] time limit in seconds, null for no limit
+	TimeLimit [2]*float64 `json:"timelimit"`
+	// Compression is content type of Compressor of the body
+	Compression string `json:"compression,omitempty"`
+	// Encryption is name of registered Encryptor of the body
+	Encryption string `json:"encryption,omitempty"`
 
 	/*TODO
 	  'meth': string method_name,
 	*/
+
+	// Extra holds custom headers that are not part of the protocol,
+	// e.g. those passed by Python callers via apply_async(headers=...)
+	Extra map[string]interface{} `json:"-"`
+}
+
+// stHeaders has the same fields as ST_Headers without its json methods
+type stHeaders ST_Headers
+
+// stHeadersKeys are the json keys of protocol headers
+var stHeadersKeys = func() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(stHeaders{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+			keys[tag] = true
+		}
+	}
+	return keys
+}()
+
+// MarshalJSON merges Extra into protocol headers
+// Headers without task name are protocol 1 headers, which have no task fields.
+func (h ST_Headers) MarshalJSON() ([]byte, error) {
+	var data []byte
+	var err error
+	if h.Task == "" {
+		data, err = json.Marshal(struct {
+			Compression string `json:"compression,omitempty"`
+			Encryption  string `json:"encryption,omitempty"`
+		}{h.Compression, h.Encryption})
+	} else {
+		data, err = json.Marshal(stHeaders(h))
+	}
+	if err != nil || len(h.Extra) == 0 {
+		return data, err
+	}
+	var merged map[string]interface{}
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, err
+	}
+	for k, v := range h.Extra {
+		if !stHeadersKeys[k] {
+			merged[k] = v
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// UnmarshalJSON collects unknown headers into Extra
+func (h *ST_Headers) UnmarshalJSON(data []byte) error {
+	var headers stHeaders
+	if err := json.Unmarshal(data, &headers); err != nil {
+		return err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for k, v := range all {
+		if k == "eta" || k == "expires" {
+			// Python sends times with microseconds and offset, e.g. 2019-02-16T10:52:44.123456+00:00
+			if s, ok := v.(string); ok {
+				t, err := convertTime(s)
+				if err != nil {
+					return err
+				}
+				if k == "eta" {
+					headers.ETA = t.Interface().(time.Time)
+				} else {
+					headers.Expires = t.Interface().(time.Time)
+				}
+			}
+		}
+		if stHeadersKeys[k] {
+			continue
+		}
+		if headers.Extra == nil {
+			headers.Extra = make(map[string]interface{})
+		}
+		headers.Extra[k] = v
+	}
+	*h = ST_Headers(headers)
+	return nil
+}
+
+// Protocol returns version of message protocol, task name is a header in protocol 2 only
+func (cm *CeleryMessage) Protocol() int {
+	if cm.Headers.Task == "" {
+		return 1
+	}
+	return 2
 }
 
 func (cm *CeleryMessage) reset() {
 	cm.Headers = ST_Headers{}
 	cm.Body = ""
+	cm.ContentType = "application/json"
+	cm.ContentEncoding = "utf-8"
 	cm.Properties.CorrelationID = generateUUID()
 	cm.Properties.ReplyTo = generateUUID()
 	cm.Properties.DeliveryTag = generateUUID()
@@ -153,7 +253,7 @@ var celeryMessagePool = sync.Pool{
 		return &CeleryMessage{
 			Body: "",
 			Headers: ST_Headers{
-				Lang: "golang",
+				Lang: "py",
 			},
 			ContentType:     "application/json",
 			ContentEncoding: "utf-8",
@@ -194,42 +294,84 @@ func getCeleryMessage(encodedTaskMessage string, deliveryInfo *CeleryDeliveryInf
 CeleryTask -> CeleryMessage
 */
 func Task2Msg(task *CeleryTask) *CeleryMessage {
+	msg := task2Headers(task)
+	setReprHeaders(task, msg, nil, defaultReprMaxSize)
+	if err := encodeMessageBody(task, msg); err != nil {
+		log.Printf("celery message encode failed: %v", err)
+	}
+	return msg
+}
+
+// task2Headers builds CeleryMessage from task without encoding its body
+func task2Headers(task *CeleryTask) *CeleryMessage {
 	msg := celeryMessagePool.Get().(*CeleryMessage)
-	msg.Body = task.EncodeBody()
 	msg.Properties.DeliveryInfo = *getDefaultCeleryDeliveryInfo()
 	msg.Properties.Priority = task.Priority
 	msg.Properties.CorrelationID = task.Id
-	msg.Headers.RootId = task.Id
+	if task.ReplyTo != "" {
+		msg.Properties.ReplyTo = task.ReplyTo
+	}
+	if task.Protocol == 1 {
+		// task fields are sent in body
+		msg.Headers = ST_Headers{Extra: task.Headers}
+		return msg
+	}
+	msg.Headers.Lang = "py"
+	msg.Headers.RootId = task.RootId
+	if msg.Headers.RootId == "" {
+		msg.Headers.RootId = task.Id
+	}
+	msg.Headers.ParentId = task.ParentId
 	msg.Headers.TaskId = task.Id
 	msg.Headers.Task = task.Task
+	msg.Headers.Origin = origin
+	msg.Headers.Shadow = task.Shadow
+	msg.Headers.ArgsRepr = task.ArgsRepr
+	msg.Headers.KwargsRepr = task.KwargsRepr
+	msg.Headers.TimeLimit = [2]*float64{durationSeconds(task.TimeLimit), durationSeconds(task.SoftTimeLimit)}
 	msg.Headers.ETA = task.ETA
 	msg.Headers.Expires = task.Expires
 	msg.Headers.Retries = task.Retries
+	msg.Headers.Extra = task.Headers
 	return msg
 }
 
 func Msg2Task(msg *CeleryMessage) *CeleryTask {
-	// ensure content-type is 'application/json'
-	if msg.ContentType != "application/json" {
-		log.Println("unsupported content type " + msg.ContentType)
-		return nil
-	}
 	// ensure body encoding is base64
 	if msg.Properties.BodyEncoding != "base64" {
 		log.Println("unsupported body encoding " + msg.Properties.BodyEncoding)
 		return nil
 	}
+	if msg.Protocol() == 1 {
+		return msg2TaskV1(msg)
+	}
 	var task = CeleryTask{}
 	task.Id = msg.Headers.TaskId
+	task.RootId = msg.Headers.RootId
+	task.ParentId = msg.Headers.ParentId
 	task.ETA = msg.Headers.ETA
+	task.Expires = msg.Headers.Expires
+	task.Retries = msg.Headers.Retries
 	task.Task = msg.Headers.Task
 	task.Priority = msg.Properties.Priority
+	task.ReplyTo = msg.Properties.ReplyTo
+	task.DeliveryInfo = &CeleryDeliveryInfo{}
+	*task.DeliveryInfo = msg.Properties.DeliveryInfo
+	task.Headers = msg.Headers.Extra
 	// TODO: task.Args = msg.Headers.ArgsRepr
 	// TODO: task.Kwargs = msg.Headers.kwargsRepr
+	task.Serializer = msg.ContentType
+	task.Compression = msg.Headers.Compression
+	task.Encryption = msg.Headers.Encryption
+	task.Shadow = msg.Headers.Shadow
+	task.ArgsRepr = msg.Headers.ArgsRepr
+	task.KwargsRepr = msg.Headers.KwargsRepr
+	task.TimeLimit = secondsDuration(msg.Headers.TimeLimit[0])
+	task.SoftTimeLimit = secondsDuration(msg.Headers.TimeLimit[1])
 	// decode body
-	var body = DecodeBody(msg.Body)
-	if body == nil {
-		log.Println("failed to decode task message")
+	body, err := decodeMessageBody(msg)
+	if err != nil {
+		log.Printf("failed to decode task message: %v", err)
 		return nil
 	}
 	if body.Args != nil {
@@ -240,6 +382,81 @@ func Msg2Task(msg *CeleryMessage) *CeleryTask {
 	}
 	return &task
 }
+
+// durationSeconds converts positive duration to seconds, nil means no limit
+func durationSeconds(d time.Duration) *float64 {
+	if d <= 0 {
+		return nil
+	}
+	seconds := d.Seconds()
+	return &seconds
+}
+
+// secondsDuration converts seconds to duration, nil means no limit
+func secondsDuration(seconds *float64) time.Duration {
+	if seconds == nil {
+		return 0
+	}
+	return time.Duration(*seconds * float64(time.Second))
+}
+
+// msg2TaskV1 decodes protocol 1 message, whose body holds all task fields
+func msg2TaskV1(msg *CeleryMessage) *CeleryTask {
+	data, serializer, err := decodeMessageData(msg)
+	if err != nil {
+		log.Printf("failed to decode task message: %v", err)
+		return nil
+	}
+	var body map[string]interface{}
+	if err := serializer.Unmarshal(data, &body); err != nil {
+		log.Printf("failed to decode task message: %v", err)
+		return nil
+	}
+	fields, err := ConvertArg(body, reflect.TypeOf(taskBodyV1{}))
+	if err != nil {
+		log.Printf("failed to decode task message: %v", err)
+		return nil
+	}
+	v1 := fields.Interface().(taskBodyV1)
+	if v1.Task == "" {
+		log.Printf("failed to decode task message: no task name")
+		return nil
+	}
+	var task = CeleryTask{}
+	task.Id = v1.Id
+	task.Task = v1.Task
+	task.Args = v1.Args
+	task.Kwargs = v1.Kwargs
+	task.Retries = v1.Retries
+	if v1.ETA != nil {
+		task.ETA = *v1.ETA
+	}
+	if v1.Expires != nil {
+		task.Expires = *v1.Expires
+	}
+	task.Priority = msg.Properties.Priority
+	task.ReplyTo = msg.Properties.ReplyTo
+	task.DeliveryInfo = &CeleryDeliveryInfo{}
+	*task.DeliveryInfo = msg.Properties.DeliveryInfo
+	task.Headers = msg.Headers.Extra
+	task.Serializer = msg.ContentType
+	task.Compression = msg.Headers.Compression
+	task.Encryption = msg.Headers.Encryption
+	task.Protocol = 1
+	return &task
+}
+
+// taskBodyV1 are fields of protocol 1 body used by CeleryTask
+type taskBodyV1 struct {
+	Task    string                 `json:"task"`
+	Id      string                 `json:"id"`
+	Args    []interface{}          `json:"args"`
+	Kwargs  map[string]interface{} `json:"kwargs"`
+	Retries int                    `json:"retries"`
+	ETA     *time.Time             `json:"eta"`
+	Expires *time.Time             `json:"expires"`
+}
+
 func releaseCeleryMessage(v *CeleryMessage) {
 	v.reset()
 	celeryMessagePool.Put(v)
@@ -263,6 +480,37 @@ type CeleryTask struct {
 	Expires  time.Time              `json:"expires" time_format:"2006-01-02T15:04:05"`
 	Priority int                    `json:"priority"`
 	Embed    map[string]interface{} `json:"embed"`
+	// Headers are custom message headers, see ST_Headers.Extra
+	Headers map[string]interface{} `json:"-"`
+	// Serializer is name or content type of registered Serializer of the body, json by default
+	Serializer string `json:"-"`
+	// Compression is name or content type of registered Compressor of the body, not compressed by default
+	Compression string `json:"-"`
+	// Encryption is name of registered Encryptor of the body, not encrypted by default
+	Encryption string `json:"-"`
+	// Protocol is version of message protocol, 2 by default
+	Protocol int `json:"-"`
+	// Shadow is task name shown in logs and monitoring instead of Task
+	Shadow string `json:"-"`
+	// ArgsRepr and KwargsRepr are shown in logs and monitoring, rendered from Args and Kwargs if empty
+	ArgsRepr   string `json:"-"`
+	KwargsRepr string `json:"-"`
+	// TimeLimit and SoftTimeLimit of task execution, no limit if zero
+	TimeLimit     time.Duration `json:"-"`
+	SoftTimeLimit time.Duration `json:"-"`
+	// RootId and ParentId are ids of the first and the calling task of a task tree
+	RootId   string `json:"-"`
+	ParentId string `json:"-"`
+	// ReplyTo is the queue result is sent to by ReplyBackend, set by client
+	ReplyTo string `json:"-"`
+
+	// DeliveryInfo of received task
+	DeliveryInfo *CeleryDeliveryInfo `json:"-"`
+	// Acknowledger of received task, set by brokers acknowledging tasks late
+	Acknowledger TaskAcknowledger `json:"-"`
+
+	// context is set while the task is run by worker
+	context *TaskContext
 }
 
 func (tm *CeleryTask) reset() {
@@ -270,6 +518,27 @@ func (tm *CeleryTask) reset() {
 	tm.Task = ""
 	tm.Args = nil
 	tm.Kwargs = nil
+	tm.Retries = 0
+	tm.ETA = time.Time{}
+	tm.Expires = time.Time{}
+	tm.Priority = 0
+	tm.Embed = nil
+	tm.Headers = nil
+	tm.Serializer = ""
+	tm.Compression = ""
+	tm.Encryption = ""
+	tm.Protocol = 0
+	tm.Shadow = ""
+	tm.ArgsRepr = ""
+	tm.KwargsRepr = ""
+	tm.TimeLimit = 0
+	tm.SoftTimeLimit = 0
+	tm.RootId = ""
+	tm.ParentId = ""
+	tm.ReplyTo = ""
+	tm.DeliveryInfo = nil
+	tm.Acknowledger = nil
+	tm.context = nil
 }
 
 var taskMessagePool = sync.Pool{
@@ -317,34 +586,185 @@ func (body *PythonBody) UnmarshalJSON(buf []byte) error {
 
 // DecodeTaskMessage decodes base64 encrypted body
 func DecodeBody(encodedBody string) *PythonBody {
-	body, err := base64.StdEncoding.DecodeString(encodedBody)
-	if err != nil {
-		return nil
-	}
 	/**
 	  [[], {"y": 2878, "x": 5456}, {"chord": null, "callbacks": null, "errbacks": null, "chain": null}]
 	*/
-	// var payloadStrArr = make([]string, 3)
-	var pybody PythonBody
-	json.Unmarshal(body, &pybody)
-	return &pybody
+	serializer, _ := GetSerializer("json")
+	body, err := DecodeBodyAs(encodedBody, serializer)
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// DecodeBodyAs decodes base64 encoded body serialized by serializer
+func DecodeBodyAs(encodedBody string, serializer Serializer) (*PythonBody, error) {
+	data, err := base64.StdEncoding.DecodeString(encodedBody)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalBody(data, serializer)
+}
+
+// unmarshalBody decodes [args, kwargs, embed] payload serialized by serializer
+func unmarshalBody(data []byte, serializer Serializer) (*PythonBody, error) {
+	var payload []interface{}
+	if err := serializer.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	if len(payload) != 3 {
+		return nil, fmt.Errorf("wrong number of fields in body: %d != 3", len(payload))
+	}
+	var body PythonBody
+	var ok bool
+	if body.Args, ok = payload[0].([]interface{}); !ok && payload[0] != nil {
+		return nil, fmt.Errorf("malformed args %v", payload[0])
+	}
+	if body.Kwargs, ok = payload[1].(map[string]interface{}); !ok && payload[1] != nil {
+		return nil, fmt.Errorf("malformed kwargs %v", payload[1])
+	}
+	if body.Embed, ok = payload[2].(map[string]interface{}); !ok && payload[2] != nil {
+		return nil, fmt.Errorf("malformed embed %v", payload[2])
+	}
+	return &body, nil
+}
+
+// decodeMessageBody decodes protocol 2 body of msg
+func decodeMessageBody(msg *CeleryMessage) (*PythonBody, error) {
+	data, serializer, err := decodeMessageData(msg)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalBody(data, serializer)
+}
+
+// decodeMessageData decrypts and decompresses body of msg and returns it with serializer of its content type
+func decodeMessageData(msg *CeleryMessage) ([]byte, Serializer, error) {
+	serializer, err := GetSerializer(msg.ContentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg.Headers.Encryption != "" {
+		encryptor, err := GetEncryptor(msg.Headers.Encryption)
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, err = encryptor.Decrypt(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if msg.Headers.Compression != "" {
+		compressor, err := GetCompressor(msg.Headers.Compression)
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, err = compressor.Decompress(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, serializer, nil
 }
 
 // EncodeBody returns base64 json encoded string
 func (tm *CeleryTask) EncodeBody() string {
+	serializer, _ := GetSerializer("json")
+	encodedData, err := tm.EncodeBodyAs(serializer)
+	if err != nil {
+		log.Fatalf("celery message encode failed: %s", err.Error())
+	}
+	return encodedData
+}
+
+// EncodeBodyAs returns base64 encoded body serialized by serializer
+func (tm *CeleryTask) EncodeBodyAs(serializer Serializer) (string, error) {
+	data, err := tm.marshalBody(serializer)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// marshalBody serializes [args, kwargs, embed] payload
+func (tm *CeleryTask) marshalBody(serializer Serializer) ([]byte, error) {
 	// python兼容版本
 	// args, kwargs, embed = self._payload # _payload is body
 	var payloadList = make([]interface{}, 3)
 	payloadList[0] = tm.Args
 	payloadList[1] = tm.Kwargs
 	payloadList[2] = tm.Embed
-	var jsonData, err = json.Marshal(payloadList)
-	log.Printf("json body: %s", jsonData)
+	return serializer.Marshal(payloadList)
+}
+
+// marshalBodyV1 serializes protocol 1 body with all task fields
+func (tm *CeleryTask) marshalBodyV1(serializer Serializer) ([]byte, error) {
+	// python: celery.app.amqp.AMQP.as_task_v1
+	isoTime := func(t time.Time) interface{} {
+		if t.IsZero() {
+			return nil
+		}
+		return t.Format("2006-01-02T15:04:05.000000-07:00")
+	}
+	return serializer.Marshal(map[string]interface{}{
+		"task":      tm.Task,
+		"id":        tm.Id,
+		"args":      tm.Args,
+		"kwargs":    tm.Kwargs,
+		"group":     nil,
+		"retries":   tm.Retries,
+		"eta":       isoTime(tm.ETA),
+		"expires":   isoTime(tm.Expires),
+		"utc":       true,
+		"callbacks": nil,
+		"errbacks":  nil,
+		"timelimit": []interface{}{nil, nil},
+		"taskset":   nil,
+		"chord":     nil,
+	})
+}
+
+// encodeMessageBody encodes body of task into msg with serializer, compression and encryption of the task
+func encodeMessageBody(task *CeleryTask, msg *CeleryMessage) error {
+	serializer, err := GetSerializer(task.Serializer)
 	if err != nil {
-		log.Fatalf("celery message encode failed: %s", err.Error())
+		return err
 	}
-	encodedData := base64.StdEncoding.EncodeToString(jsonData)
-	return encodedData
+	var data []byte
+	if task.Protocol == 1 {
+		data, err = task.marshalBodyV1(serializer)
+	} else {
+		data, err = task.marshalBody(serializer)
+	}
+	if err != nil {
+		return err
+	}
+	if task.Compression != "" {
+		compressor, err := GetCompressor(task.Compression)
+		if err != nil {
+			return err
+		}
+		if data, err = compressor.Compress(data); err != nil {
+			return err
+		}
+		msg.Headers.Compression = compressor.ContentType()
+	}
+	if task.Encryption != "" {
+		encryptor, err := GetEncryptor(task.Encryption)
+		if err != nil {
+			return err
+		}
+		if data, err = encryptor.Encrypt(data); err != nil {
+			return err
+		}
+		msg.Headers.Encryption = task.Encryption
+	}
+	msg.Body = base64.StdEncoding.EncodeToString(data)
+	msg.ContentType = serializer.ContentType()
+	msg.ContentEncoding = serializer.ContentEncoding()
+	return nil
 }
 
 // ResultMessage is return message received from broker
@@ -354,16 +774,38 @@ type ResultMessage struct {
 	Traceback interface{}   `json:"traceback"`
 	Result    interface{}   `json:"result"`
 	Children  []interface{} `json:"children"`
+
+	// err is the error of failed task, it is not stored
+	err error
+}
+
+// Celery task states stored in ResultMessage.Status
+const (
+	StatePending = "PENDING"
+	StateStarted = "STARTED"
+	StateRetry   = "RETRY"
+	StateFailure = "FAILURE"
+	StateSuccess = "SUCCESS"
+	StateRevoked = "REVOKED"
+)
+
+// isReadyState checks whether state is final, tasks may have custom states which are not
+func isReadyState(state string) bool {
+	return state == StateSuccess || state == StateFailure || state == StateRevoked
 }
 
 func (rm *ResultMessage) reset() {
+	rm.Status = StateSuccess
+	rm.Traceback = nil
 	rm.Result = nil
+	rm.Children = nil
+	rm.err = nil
 }
 
 var resultMessagePool = sync.Pool{
 	New: func() interface{} {
 		return &ResultMessage{
-			Status:    "SUCCESS",
+			Status:    StateSuccess,
 			Traceback: nil,
 			Children:  nil,
 		}
@@ -382,6 +824,40 @@ func getReflectionResultMessage(val *reflect.Value) *ResultMessage {
 	return msg
 }
 
+// getFailureResultMessage builds FAILURE result the way Celery serializes exceptions,
+// Go error type name is used as exception type. RetryError is stored as RETRY like celery Retry.
+func getFailureResultMessage(err error, traceback interface{}) *ResultMessage {
+	msg := resultMessagePool.Get().(*ResultMessage)
+	excType := reflect.TypeOf(err).String()
+	excType = excType[strings.LastIndex(excType, ".")+1:]
+	excModule := "builtins"
+	msg.Status = StateFailure
+	if _, ok := err.(*RetryError); ok {
+		excType, excModule = "Retry", "celery.exceptions"
+		msg.Status = StateRetry
+	}
+	msg.Result = map[string]interface{}{
+		"exc_type":    excType,
+		"exc_message": []interface{}{err.Error()},
+		"exc_module":  excModule,
+	}
+	msg.Traceback = traceback
+	msg.err = err
+	return msg
+}
+
+// resultError returns error describing unsuccessful result
+func resultError(result *ResultMessage) error {
+	if result.Status != StateFailure {
+		return fmt.Errorf("error response status %v", result)
+	}
+	exc, ok := result.Result.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("task %s failed: %v", result.ID, result.Result)
+	}
+	return fmt.Errorf("task %s failed: %v%v", result.ID, exc["exc_type"], exc["exc_message"])
+}
+
 func releaseResultMessage(v *ResultMessage) {
 	v.reset()
 	resultMessagePool.Put(v)
@@ -63,3 +63,44 @@ func TestDecodeBody(t *testing.T) {
 	assert.Equal(t, body.Kwargs["x"], float64(5456))
 	t.Logf("%v", body)
 }
+
+func TestProtocolV1(t *testing.T) {
+	// sent by Celery 3.1 producer, body is
+	// {"task": "worker.add", "id": "a4d7a0f3-...", "args": [5456, 2878], "kwargs": {}, "retries": 1,
+	//  "eta": "2019-02-16T10:52:44.123456+00:00", "expires": null, "utc": true, ...}
+	var msgJson = `{"body": "eyJ0YXNrIjogIndvcmtlci5hZGQiLCAiaWQiOiAiYTRkN2EwZjMtNmZhMS00YzRiLTljM2ItNTJlNGIxYTRiNmYwIiwgImFyZ3MiOiBbNTQ1NiwgMjg3OF0sICJrd2FyZ3MiOiB7fSwgImdyb3VwIjogbnVsbCwgInJldHJpZXMiOiAxLCAiZXRhIjogIjIwMTktMDItMTZUMTA6NTI6NDQuMTIzNDU2KzAwOjAwIiwgImV4cGlyZXMiOiBudWxsLCAidXRjIjogdHJ1ZSwgImNhbGxiYWNrcyI6IG51bGwsICJlcnJiYWNrcyI6IG51bGwsICJ0aW1lbGltaXQiOiBbbnVsbCwgbnVsbF0sICJ0YXNrc2V0IjogbnVsbCwgImNob3JkIjogbnVsbH0=", "headers": {}, "content-type": "application/json", "properties": {"priority": 0, "body_encoding": "base64", "correlation_id": "a4d7a0f3-6fa1-4c4b-9c3b-52e4b1a4b6f0", "reply_to": "", "delivery_info": {"routing_key": "celery", "exchange": "celery"}, "delivery_mode": 2, "delivery_tag": "b7dfd826-df49-45b0-8cf7-20bd7c6611b0"}, "content-encoding": "utf-8"}`
+	var message = &CeleryMessage{}
+	if err := jsonj.Unmarshal([]byte(msgJson), message); err != nil {
+		t.Fatalf("parse failed: %s", err.Error())
+	}
+	assert.Equal(t, message.Protocol(), 1)
+	task := Msg2Task(message)
+	if task == nil {
+		t.Fatalf("failed to decode protocol 1 message")
+	}
+	assert.Equal(t, task.Task, "worker.add")
+	assert.Equal(t, task.Id, "a4d7a0f3-6fa1-4c4b-9c3b-52e4b1a4b6f0")
+	assert.Equal(t, task.Args[0], float64(5456))
+	assert.Equal(t, task.Retries, 1)
+	assert.Equal(t, task.ETA.UnixNano(), int64(1550314364123456000))
+	assert.Assert(t, task.Expires.IsZero())
+
+	broker := &memoryBroker{}
+	client, _ := NewCeleryClient(broker, nil, ClientProtocol(1))
+	if _, err := client.DelayKwargs("worker.add", map[string]interface{}{"x": float64(1)}); err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	data, _ := jsonj.Marshal(broker.messages[0])
+	var sent map[string]interface{}
+	jsonj.Unmarshal(data, &sent)
+	assert.DeepEqual(t, sent["headers"], map[string]interface{}{})
+	task, _ = broker.GetTask()
+	if task == nil {
+		t.Fatalf("failed to decode protocol 1 message")
+	}
+	assert.Equal(t, task.Task, "worker.add")
+	assert.Equal(t, task.Kwargs["x"], float64(1))
+	if _, err := NewCeleryClient(broker, nil, ClientProtocol(3)); err == nil {
+		t.Errorf("unsupported protocol was accepted")
+	}
+}
@@ -0,0 +1,262 @@
+package gocelery
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultReprMaxSize is the default size of argsrepr and kwargsrepr headers,
+// like argsrepr_maxsize and kwargsrepr_maxsize of Celery
+const defaultReprMaxSize = 1024
+
+// redactedRepr replaces values of redacted kwargs in kwargsrepr header
+const redactedRepr = "'***'"
+
+// encryptedRepr replaces argsrepr and kwargsrepr headers of tasks with encrypted body,
+// whose arguments must not be sent in clear
+const encryptedRepr = "<encrypted>"
+
+// origin is name of this producer, like anon_nodename() of Celery
+var origin = func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("gen%d@%s", os.Getpid(), hostname)
+}()
+
+// setReprHeaders renders argsrepr and kwargsrepr headers of message which were not set explicitly,
+// it is called when the message is published so that changes of interceptors are shown
+func setReprHeaders(task *CeleryTask, message *CeleryMessage, redacted []string, maxSize int) {
+	if task.Protocol == 1 {
+		// protocol 1 has no such headers
+		return
+	}
+	if message.Headers.ArgsRepr == "" {
+		if task.Encryption != "" {
+			message.Headers.ArgsRepr = encryptedRepr
+		} else {
+			message.Headers.ArgsRepr = reprArgs(task.Args, maxSize)
+		}
+	}
+	if message.Headers.KwargsRepr == "" {
+		if task.Encryption != "" {
+			message.Headers.KwargsRepr = encryptedRepr
+		} else {
+			message.Headers.KwargsRepr = reprKwargs(task.Kwargs, redacted, maxSize)
+		}
+	}
+}
+
+// reprArgs renders args like Python repr of a tuple, truncated to maxSize
+func reprArgs(args []interface{}, maxSize int) string {
+	var buf strings.Builder
+	buf.WriteByte('(')
+	for i, arg := range args {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		writeRepr(&buf, reflect.ValueOf(arg))
+	}
+	if len(args) == 1 {
+		buf.WriteByte(',')
+	}
+	buf.WriteByte(')')
+	return truncateRepr(buf.String(), maxSize)
+}
+
+// reprKwargs renders kwargs like Python repr of a dict, truncated to maxSize
+// Values of redacted keys are hidden.
+func reprKwargs(kwargs map[string]interface{}, redacted []string, maxSize int) string {
+	keys := make([]string, 0, len(kwargs))
+	for k := range kwargs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		writeRepr(&buf, reflect.ValueOf(k))
+		buf.WriteString(": ")
+		if indexOf(redacted, k) >= 0 {
+			buf.WriteString(redactedRepr)
+		} else {
+			writeRepr(&buf, reflect.ValueOf(kwargs[k]))
+		}
+	}
+	buf.WriteByte('}')
+	return truncateRepr(buf.String(), maxSize)
+}
+
+// truncateRepr cuts repr longer than maxSize and marks it with ellipsis
+func truncateRepr(repr string, maxSize int) string {
+	if maxSize <= 0 || len(repr) <= maxSize {
+		return repr
+	}
+	cut := maxSize
+	for cut > 0 && !utf8.RuneStart(repr[cut]) {
+		cut--
+	}
+	return repr[:cut] + "..."
+}
+
+// writeRepr renders value as Python would render it after decoding it from json
+func writeRepr(buf *strings.Builder, val reflect.Value) {
+	if !val.IsValid() {
+		buf.WriteString("None")
+		return
+	}
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			buf.WriteString("None")
+			return
+		}
+		writeRepr(buf, val.Elem())
+	case reflect.Bool:
+		if val.Bool() {
+			buf.WriteString("True")
+		} else {
+			buf.WriteString("False")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteString(strconv.FormatInt(val.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteString(strconv.FormatUint(val.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		buf.WriteString(reprFloat(val.Float()))
+	case reflect.String:
+		if val.Type() == jsonNumberType {
+			buf.WriteString(val.String())
+			return
+		}
+		buf.WriteString(reprString(val.String()))
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && val.IsNil() {
+			buf.WriteString("None")
+			return
+		}
+		if val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8 {
+			// bytes are sent as base64 string
+			writeRepr(buf, reflect.ValueOf(jsonGeneric(val.Interface())))
+			return
+		}
+		buf.WriteByte('[')
+		for i := 0; i < val.Len(); i++ {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeRepr(buf, val.Index(i))
+		}
+		buf.WriteByte(']')
+	case reflect.Map:
+		if val.IsNil() {
+			buf.WriteString("None")
+			return
+		}
+		keys := val.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			// json object keys are always strings
+			writeRepr(buf, reflect.ValueOf(fmt.Sprint(k.Interface())))
+			buf.WriteString(": ")
+			writeRepr(buf, val.MapIndex(k))
+		}
+		buf.WriteByte('}')
+	default:
+		// structs and other values are rendered as their json representation
+		writeRepr(buf, reflect.ValueOf(jsonGeneric(val.Interface())))
+	}
+}
+
+// jsonNumberType is type of numbers in generic json values of jsonGeneric
+var jsonNumberType = reflect.TypeOf(stdjson.Number(""))
+
+// jsonGeneric converts value into generic json value, keeping numbers as they were encoded
+func jsonGeneric(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	decoder := stdjson.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return fmt.Sprint(v)
+	}
+	return generic
+}
+
+// reprFloat renders float like Python, integral values are decoded by Python as int
+func reprFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	case f == math.Trunc(f) && math.Abs(f) < 1e21:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	exp := math.Floor(math.Log10(math.Abs(f)))
+	if exp < -4 || exp >= 16 {
+		return strconv.FormatFloat(f, 'e', -1, 64)
+	}
+	repr := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(repr, ".") {
+		repr += ".0"
+	}
+	return repr
+}
+
+// reprString renders string like Python 3 repr of str
+func reprString(s string) string {
+	quote := byte('\'')
+	if strings.ContainsRune(s, '\'') && !strings.ContainsRune(s, '"') {
+		quote = '"'
+	}
+	var buf strings.Builder
+	buf.WriteByte(quote)
+	for _, r := range s {
+		switch {
+		case r == rune(quote) || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case unicode.IsPrint(r):
+			buf.WriteRune(r)
+		case r < 0x100:
+			fmt.Fprintf(&buf, `\x%02x`, r)
+		case r < 0x10000:
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		default:
+			fmt.Fprintf(&buf, `\U%08x`, r)
+		}
+	}
+	buf.WriteByte(quote)
+	return buf.String()
+}
@@ -0,0 +1,81 @@
+package gocelery
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepr(t *testing.T) {
+	cases := []struct {
+		args     []interface{}
+		expected string
+	}{
+		{nil, "()"},
+		{[]interface{}{float64(1)}, "(1,)"},
+		{[]interface{}{1, float64(2.5), "a", nil, true}, "(1, 2.5, 'a', None, True)"},
+		{[]interface{}{float64(1e-05), float64(1e22), float64(100)}, "(1e-05, 1e+22, 100)"},
+		{[]interface{}{"it's", `say "hi"`, "it's \"both\"", "new\nline\x00"},
+			`("it's", 'say "hi"', 'it\'s "both"', 'new\nline\x00')`},
+		{[]interface{}{[]string{"a"}, map[string]int{"b": 1}, []interface{}{}}, "(['a'], {'b': 1}, [])"},
+		{[]interface{}{convertPoint{X: 1, Y: 2}, []byte("hi")}, "({'x': 1, 'y': 2}, 'aGk=')"},
+		{[]interface{}{time.Date(2019, 2, 16, 10, 52, 44, 0, time.UTC)}, "('2019-02-16T10:52:44Z',)"},
+	}
+	for _, c := range cases {
+		if repr := reprArgs(c.args, defaultReprMaxSize); repr != c.expected {
+			t.Errorf("unexpected repr %s of %v, expected %s", repr, c.args, c.expected)
+		}
+	}
+	kwargs := map[string]interface{}{"y": float64(2878), "x": float64(5456), "password": "secret"}
+	if repr := reprKwargs(kwargs, []string{"password"}, defaultReprMaxSize); repr != "{'password': '***', 'x': 5456, 'y': 2878}" {
+		t.Errorf("unexpected kwargs repr %s", repr)
+	}
+	if repr := reprArgs([]interface{}{strings.Repeat("é", 10)}, 8); repr != "('ééé..." {
+		t.Errorf("unexpected truncated repr %s", repr)
+	}
+}
+
+func TestReprHeaders(t *testing.T) {
+	broker := &memoryBroker{}
+	client, _ := NewCeleryClient(broker, nil, ClientRedactKwargs("token"), ClientReprMaxSize(20))
+	client.DelayKwargs("login", map[string]interface{}{"token": "secret", "user": strings.Repeat("u", 30)})
+	client.ApplyAsync("login", []interface{}{"secret"}, nil, nil, nil, false, "", 0, "", "",
+		ApplyShadow("auth.login"), ApplyTimeLimit(time.Minute, 30*time.Second), ApplyArgsRepr("('***',)", ""))
+	headers := broker.messages[0].Headers
+	if headers.Lang != "py" || !strings.HasPrefix(headers.Origin, "gen") || !strings.Contains(headers.Origin, "@") {
+		t.Errorf("unexpected lang %s and origin %s", headers.Lang, headers.Origin)
+	}
+	if headers.ArgsRepr != "()" || headers.KwargsRepr != "{'token': '***', 'us..." {
+		t.Errorf("unexpected repr %s %s", headers.ArgsRepr, headers.KwargsRepr)
+	}
+	if headers.TimeLimit[0] != nil || headers.TimeLimit[1] != nil {
+		t.Errorf("unexpected time limit %v", headers.TimeLimit)
+	}
+	headers = broker.messages[1].Headers
+	if headers.Shadow != "auth.login" || headers.ArgsRepr != "('***',)" || headers.KwargsRepr != "{}" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+	if headers.TimeLimit[0] == nil || *headers.TimeLimit[0] != 60 || *headers.TimeLimit[1] != 30 {
+		t.Errorf("unexpected time limit %v", headers.TimeLimit)
+	}
+	broker.GetTask()
+	task, _ := broker.GetTask()
+	if task.TimeLimit != time.Minute || task.SoftTimeLimit != 30*time.Second || task.Shadow != "auth.login" {
+		t.Errorf("headers were not decoded: %v %v %s", task.TimeLimit, task.SoftTimeLimit, task.Shadow)
+	}
+}
+
+func TestReprHeadersInterceptor(t *testing.T) {
+	broker := &memoryBroker{}
+	client, _ := NewCeleryClient(broker, nil, ClientRedactKwargs("token"))
+	client.Use(func(task *CeleryTask, message *CeleryMessage, next PublishHandler) error {
+		task.Args = append(task.Args, "tenant")
+		task.Kwargs["token"] = "secret"
+		return next(task, message)
+	})
+	client.Delay("login", "user")
+	headers := broker.messages[0].Headers
+	if headers.ArgsRepr != "('user', 'tenant')" || headers.KwargsRepr != "{'token': '***'}" {
+		t.Errorf("unexpected repr %s %s", headers.ArgsRepr, headers.KwargsRepr)
+	}
+}
@@ -2,51 +2,194 @@ package gocelery
 
 import (
     "fmt"
+    "log"
+    "sync"
+    "time"
 
     "github.com/garyburd/redigo/redis"
 )
 
 // RedisCeleryBackend is CeleryBackend for Redis
+// Like Celery, results are published to channel named by their key when they are stored,
+// so that AsyncResult.Get is notified of them.
 type RedisCeleryBackend struct {
     *redis.Pool
+    options    backendOptions
+    subscriber *redisSubscriber
 }
 
 // Support Broker Options: https://github.com/gocelery/gocelery/pull/31
-func NewRedisCeleryBackend(host string, port int, db int, pass string) *RedisCeleryBackend {
+func NewRedisCeleryBackend(host string, port int, db int, pass string, options ...BackendOptions) *RedisCeleryBackend {
+    pool := NewRedisPool(host, port, db, pass)
     return &RedisCeleryBackend{
-        Pool: NewRedisPool(host, port, db, pass),
+        Pool:    pool,
+        options: newBackendOptions(options),
+        subscriber: &redisSubscriber{
+            pool:    pool,
+            waiters: make(map[string]map[chan struct{}]bool),
+        },
     }
 }
 
+// redisResultKey returns key and channel of result of task
+func redisResultKey(taskID string) string {
+    return fmt.Sprintf("celery-task-meta-%s", taskID)
+}
+
 // GetResult calls API to get asynchronous result
 // Should be called by AsyncResult
 func (cb *RedisCeleryBackend) GetResult(taskID string) (*ResultMessage, error) {
-    // "celery-task-meta-" + taskID
     conn := cb.Get()
     defer conn.Close()
-    val, err := conn.Do("GET", fmt.Sprintf("celery-task-meta-%s", taskID))
+    val, err := conn.Do("GET", redisResultKey(taskID))
     if err != nil {
         return nil, err
     }
     if val == nil {
-        return nil, fmt.Errorf("result not available")
+        return nil, ErrResultNotAvailable
     }
-    var resultMessage ResultMessage
-    err = json.Unmarshal(val.([]byte), &resultMessage)
-    if err != nil {
-        return nil, err
-    }
-    return &resultMessage, nil
+    return cb.options.decodeResult(val.([]byte), cb.options.Serializer, cb.options.Encryption)
 }
 
-// SetResult pushes result back into backend
+// SetResult pushes result back into backend and publishes it
 func (cb *RedisCeleryBackend) SetResult(taskID string, result *ResultMessage) error {
-    resBytes, err := json.Marshal(result)
+    _, resBytes, err := cb.options.encodeResult(result)
     if err != nil {
         return err
     }
     conn := cb.Get()
     defer conn.Close()
-    _, err = conn.Do("SETEX", fmt.Sprintf("celery-task-meta-%s", taskID), 86400, resBytes)
+    key := redisResultKey(taskID)
+    if _, err = conn.Do("SETEX", key, 86400, resBytes); err != nil {
+        return err
+    }
+    _, err = conn.Do("PUBLISH", key, resBytes)
     return err
 }
+
+// WaitResult subscribes to results of task published by SetResult
+// All waiting results share a single pub/sub connection.
+func (cb *RedisCeleryBackend) WaitResult(taskID string) (<-chan struct{}, func(), error) {
+    return cb.subscriber.subscribe(redisResultKey(taskID))
+}
+
+// redisSubscriber multiplexes subscriptions to channels over a single pub/sub connection
+// The connection is opened with the first subscription and opened again when it is lost,
+// waiters are notified when their channel is (re)subscribed, so that they do not miss
+// messages published meanwhile.
+type redisSubscriber struct {
+    pool    *redis.Pool
+    lock    sync.Mutex
+    conn    *redis.PubSubConn
+    waiters map[string]map[chan struct{}]bool
+}
+
+// subscribe returns channel notified of messages published to channel until cancel is called
+func (s *redisSubscriber) subscribe(channel string) (<-chan struct{}, func(), error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.conn == nil {
+        conn := &redis.PubSubConn{Conn: s.pool.Get()}
+        if err := conn.Conn.Err(); err != nil {
+            conn.Close()
+            return nil, nil, err
+        }
+        s.conn = conn
+        go s.receive(conn)
+    }
+    waiters, ok := s.waiters[channel]
+    if !ok {
+        if err := s.conn.Subscribe(channel); err != nil {
+            return nil, nil, err
+        }
+        waiters = make(map[chan struct{}]bool)
+        s.waiters[channel] = waiters
+    }
+    notify := make(chan struct{}, 1)
+    waiters[notify] = true
+    return notify, func() { s.unsubscribe(channel, notify) }, nil
+}
+
+// unsubscribe removes waiter, the channel is unsubscribed when it is the last one
+func (s *redisSubscriber) unsubscribe(channel string, notify chan struct{}) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    waiters := s.waiters[channel]
+    delete(waiters, notify)
+    if len(waiters) > 0 {
+        return
+    }
+    delete(s.waiters, channel)
+    if s.conn != nil {
+        s.conn.Unsubscribe(channel)
+    }
+}
+
+// receive notifies waiters of messages until connection is lost
+func (s *redisSubscriber) receive(conn *redis.PubSubConn) {
+    for {
+        switch v := conn.Receive().(type) {
+        case redis.Message:
+            s.notify(v.Channel)
+        case redis.Subscription:
+            if v.Kind == "subscribe" {
+                s.notify(v.Channel)
+            }
+        case error:
+            log.Printf("redis result subscription lost: %v", v)
+            conn.Close()
+            s.resubscribe(conn)
+            return
+        }
+    }
+}
+
+// notify wakes up waiters of channel
+func (s *redisSubscriber) notify(channel string) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    for notify := range s.waiters[channel] {
+        select {
+        case notify <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// resubscribe replaces lost connection and subscribes channels of waiters again,
+// unless there are none
+func (s *redisSubscriber) resubscribe(lost *redis.PubSubConn) {
+    backoff := 100 * time.Millisecond
+    for {
+        s.lock.Lock()
+        if s.conn == lost {
+            s.conn = nil
+        }
+        if s.conn != nil || len(s.waiters) == 0 {
+            s.lock.Unlock()
+            return
+        }
+        conn := &redis.PubSubConn{Conn: s.pool.Get()}
+        err := conn.Conn.Err()
+        if err == nil {
+            channels := make([]interface{}, 0, len(s.waiters))
+            for channel := range s.waiters {
+                channels = append(channels, channel)
+            }
+            err = conn.Subscribe(channels...)
+        }
+        if err == nil {
+            s.conn = conn
+            go s.receive(conn)
+            s.lock.Unlock()
+            return
+        }
+        s.lock.Unlock()
+        conn.Close()
+        log.Printf("redis result subscription failed, retrying in %s: %v", backoff, err)
+        time.Sleep(backoff)
+        if backoff *= 2; backoff > 5*time.Second {
+            backoff = 5 * time.Second
+        }
+    }
+}
@@ -10,11 +10,16 @@ import (
 )
 
 // RedisCeleryBroker is CeleryBroker for Redis
+// Like kombu, tasks are pushed to list named by routing key of their delivery info, i.e. queue
+// of their route, or to QueueName. Redis has no exchanges, exchange of the route is ignored
+// like kombu does for direct exchanges.
 type RedisCeleryBroker struct {
 	*redis.Pool
 	QueueName   string
 	stopChannel chan bool
 	workWG      sync.WaitGroup
+	// consumeQueues are lists tasks are popped from
+	consumeQueues []string
 }
 type BrokerOptions struct {
 	f func(*brokerOptions)
@@ -22,14 +27,93 @@ type BrokerOptions struct {
 
 type brokerOptions struct {
 	QueueName string
+	// Exchange, Queues, ConnectionTimeout, AcksLate, Confirms, Mandatory and PrefetchMultiplier
+	// are used by AMQP broker only
+	Exchange           *AMQPExchange
+	Queues             []*AMQPQueue
+	ConsumeQueues      []string
+	ConnectionTimeout  time.Duration
+	AcksLate           bool
+	Confirms           bool
+	Mandatory          bool
+	PrefetchMultiplier int
 }
 
+func newBrokerOptions(options []BrokerOptions) brokerOptions {
+	do := brokerOptions{QueueName: "celery", ConnectionTimeout: defaultAMQPTimeout, PrefetchMultiplier: 4}
+	for _, opt := range options {
+		opt.f(&do)
+	}
+	return do
+}
+
+// BrokerQueueName sets name of the queue tasks are consumed from
 func BrokerQueueName(queueName string) BrokerOptions {
 	return BrokerOptions{func(options *brokerOptions) {
 		options.QueueName = queueName
 	}}
 }
 
+// BrokerExchange sets exchange queues are bound to by default, used by AMQP broker
+func BrokerExchange(exchange *AMQPExchange) BrokerOptions {
+	return BrokerOptions{func(options *brokerOptions) {
+		options.Exchange = exchange
+	}}
+}
+
+// BrokerQueues declares queues with their bindings, used by AMQP broker
+// The queue named by BrokerQueueName is consumed with its configuration if it is one of them.
+func BrokerQueues(queues ...*AMQPQueue) BrokerOptions {
+	return BrokerOptions{func(options *brokerOptions) {
+		options.Queues = append(options.Queues, queues...)
+	}}
+}
+
+// BrokerConsumeQueues sets queues tasks are consumed from, the one named by BrokerQueueName by default
+func BrokerConsumeQueues(names ...string) BrokerOptions {
+	return BrokerOptions{func(options *brokerOptions) {
+		options.ConsumeQueues = append(options.ConsumeQueues, names...)
+	}}
+}
+
+// BrokerPrefetchMultiplier sets how many tasks are prefetched for each worker goroutine,
+// like worker_prefetch_multiplier of Celery, 4 by default and 0 for no limit; used by AMQP broker
+// The prefetch window of the worker is multiplier times its goroutines, plus the tasks it holds
+// until their ETA, so that held tasks do not stop it from receiving others.
+func BrokerPrefetchMultiplier(multiplier int) BrokerOptions {
+	return BrokerOptions{func(options *brokerOptions) {
+		options.PrefetchMultiplier = multiplier
+	}}
+}
+
+// BrokerConnectionTimeout sets how long sending and getting tasks wait for lost connection
+// to be reestablished, 0 makes them fail immediately; used by AMQP broker
+func BrokerConnectionTimeout(timeout time.Duration) BrokerOptions {
+	return BrokerOptions{func(options *brokerOptions) {
+		options.ConnectionTimeout = timeout
+	}}
+}
+
+// BrokerAcksLate makes tasks acknowledged after they are run instead of when they are received,
+// like acks_late of Celery, so that tasks of crashed workers are delivered again; used by AMQP broker
+// Undecodable messages are rejected, i.e. dead-lettered, see also WorkerAcksOnFailure and RejectError.
+func BrokerAcksLate(acksLate bool) BrokerOptions {
+	return BrokerOptions{func(options *brokerOptions) {
+		options.AcksLate = acksLate
+	}}
+}
+
+// BrokerPublisherConfirms makes sending of tasks wait until AMQP server confirms it has taken
+// responsibility for them, failing when they are rejected; used by AMQP broker
+// With mandatory set, tasks which are not routed to any queue are returned by the server and
+// sending them fails too, they are only logged without confirms.
+func BrokerPublisherConfirms(confirms bool, mandatory bool) BrokerOptions {
+	return BrokerOptions{func(options *brokerOptions) {
+		options.Confirms = confirms
+		options.Mandatory = mandatory
+	}}
+}
+
 // NewRedisPool creates pool of redis connections
 func NewRedisPool(host string, port int, db int, pass string) *redis.Pool {
 	return &redis.Pool{
@@ -55,23 +139,32 @@ func NewRedisPool(host string, port int, db int, pass string) *redis.Pool {
 	}
 }
 func NewRedisCeleryBroker(host string, port int, db int, pass string, options ...BrokerOptions) *RedisCeleryBroker {
-	do := brokerOptions{"celery"}
-	for _, opt := range options {
-		opt.f(&do)
+	do := newBrokerOptions(options)
+	consumeQueues := do.ConsumeQueues
+	if len(consumeQueues) == 0 {
+		consumeQueues = []string{do.QueueName}
 	}
 	return &RedisCeleryBroker{
-		Pool:      NewRedisPool(host, port, db, pass),
-		QueueName: do.QueueName,
+		Pool:          NewRedisPool(host, port, db, pass),
+		QueueName:     do.QueueName,
+		consumeQueues: consumeQueues,
 	}
 }
 
-// SendCeleryMessage sends CeleryMessage to redis queue
+// SendCeleryMessage sends CeleryMessage to redis queue named by routing key of its delivery info
 func (cb *RedisCeleryBroker) SendCeleryMessage(message *CeleryMessage) error {
+	route := &message.Properties.DeliveryInfo
+	if route.RoutingKey == "" {
+		route.RoutingKey = cb.QueueName
+	}
 	jsonBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
 	log.Printf("Send Celery message by redis broker: \n%s", jsonBytes)
 	conn := cb.Get()
 	defer conn.Close()
-	_, err = conn.Do("LPUSH", cb.QueueName, jsonBytes)
+	_, err = conn.Do("LPUSH", route.RoutingKey, jsonBytes)
 	if err != nil {
 		return err
 	}
@@ -82,7 +175,11 @@ func (cb *RedisCeleryBroker) SendCeleryMessage(message *CeleryMessage) error {
 func (cb *RedisCeleryBroker) GetCeleryMessage() (*CeleryMessage, error) {
 	conn := cb.Get()
 	defer conn.Close()
-	messageJSON, err := conn.Do("BLPOP", cb.QueueName, "1")
+	args := make([]interface{}, 0, len(cb.consumeQueues)+1)
+	for _, queue := range cb.consumeQueues {
+		args = append(args, queue)
+	}
+	messageJSON, err := conn.Do("BLPOP", append(args, "1")...)
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +188,7 @@ func (cb *RedisCeleryBroker) GetCeleryMessage() (*CeleryMessage, error) {
 	}
 	messageList := messageJSON.([]interface{})
 	// check for celery message
-	if string(messageList[0].([]byte)) != "celery" {
+	if !cb.consumes(string(messageList[0].([]byte))) {
 		return nil, fmt.Errorf("not a celery message: %v", messageList[0])
 	}
 	// parse
@@ -101,6 +198,16 @@ func (cb *RedisCeleryBroker) GetCeleryMessage() (*CeleryMessage, error) {
 	return message, nil
 }
 
+// consumes checks whether queue is consumed
+func (cb *RedisCeleryBroker) consumes(queue string) bool {
+	for _, consumed := range cb.consumeQueues {
+		if consumed == queue {
+			return true
+		}
+	}
+	return false
+}
+
 // GetTask retrieves task message from redis queue
 func (cb *RedisCeleryBroker) GetTask() (*CeleryTask, error) {
 	celeryMessage, err := cb.GetCeleryMessage()
@@ -0,0 +1,197 @@
+package gocelery
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// maxRPCResults bounds results kept by RPCCeleryBackend, like MESSAGE_BUFFER_MAX of Celery
+const maxRPCResults = 8192
+
+// RPCCeleryBackend is ReplyBackend for AMQP, compatible with Celery rpc:// backend
+// The client owns a single exclusive reply queue, which is set as reply_to of sent tasks.
+// Workers publish results and state updates there with task id as correlation_id, and
+// the client keeps the latest one of each task. Like with Celery, results can be
+// retrieved only by the client which sent the task, and only once. Results which are never
+// retrieved, e.g. of tasks sent without waiting for them, are dropped oldest first once
+// maxRPCResults are kept.
+type RPCCeleryBackend struct {
+	session *amqpSession
+	queue   string
+	options backendOptions
+	lock    sync.Mutex
+	results map[string]*ResultMessage
+	// order are tasks in the order their results were first received, possibly already retrieved,
+	// received are their sequence numbers by id
+	order    []rpcReceived
+	received map[string]uint64
+	seq      uint64
+}
+
+// rpcReceived identifies first result of task received by RPCCeleryBackend
+type rpcReceived struct {
+	taskID string
+	seq    uint64
+}
+
+// NewRPCCeleryBackend creates new RPCCeleryBackend and declares its reply queue
+func NewRPCCeleryBackend(host string, options ...BackendOptions) (*RPCCeleryBackend, error) {
+	backend := &RPCCeleryBackend{
+		queue:    generateUUID(),
+		options:  newBackendOptions(options),
+		results:  make(map[string]*ResultMessage),
+		received: make(map[string]uint64),
+	}
+	session, err := newAMQPSession(host, backend.options.ConnectionTimeout, backend.setup)
+	if err != nil {
+		return nil, err
+	}
+	backend.session = session
+	return backend, nil
+}
+
+// setup declares reply queue and starts receiving results on new channel
+// The exclusive queue is deleted with lost connection and declared again on reconnection.
+func (b *RPCCeleryBackend) setup(channel *amqp.Channel) error {
+	_, err := channel.QueueDeclare(
+		b.queue, // name
+		false,   // durable
+		true,    // autoDelete
+		true,    // exclusive
+		false,   // noWait
+		nil,     // args
+	)
+	if err != nil {
+		return err
+	}
+	deliveries, err := channel.Consume(b.queue, "", true, true, false, false, nil)
+	if err != nil {
+		return err
+	}
+	go b.receive(deliveries)
+	return nil
+}
+
+// receive dispatches results to their tasks by correlation id until deliveries are closed
+func (b *RPCCeleryBackend) receive(deliveries <-chan amqp.Delivery) {
+	for delivery := range deliveries {
+		encryption, _ := delivery.Headers["encryption"].(string)
+		result, err := b.options.decodeResult(delivery.Body, delivery.ContentType, encryption)
+		if err != nil {
+			log.Printf("failed to decode result of task %s: %v", delivery.CorrelationId, err)
+			continue
+		}
+		taskID := delivery.CorrelationId
+		if taskID == "" {
+			taskID = result.ID
+		}
+		b.store(taskID, result)
+	}
+}
+
+// store keeps result of task, dropping the oldest results beyond maxRPCResults
+func (b *RPCCeleryBackend) store(taskID string, result *ResultMessage) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	previous, ok := b.results[taskID]
+	if ok && isReadyState(previous.Status) {
+		// final state is never replaced by late state updates
+		return
+	}
+	b.results[taskID] = result
+	if ok {
+		return
+	}
+	b.seq++
+	b.received[taskID] = b.seq
+	b.order = append(b.order, rpcReceived{taskID, b.seq})
+	for len(b.results) > maxRPCResults {
+		oldest := b.order[0]
+		b.order = b.order[1:]
+		b.forget(oldest)
+	}
+	if len(b.order) > 2*maxRPCResults {
+		// drop tasks whose results were retrieved
+		order := make([]rpcReceived, 0, len(b.results))
+		for _, received := range b.order {
+			if b.received[received.taskID] == received.seq {
+				order = append(order, received)
+			}
+		}
+		b.order = order
+	}
+}
+
+// forget drops result of task unless it was retrieved and received again since
+func (b *RPCCeleryBackend) forget(received rpcReceived) {
+	if b.received[received.taskID] == received.seq {
+		delete(b.results, received.taskID)
+		delete(b.received, received.taskID)
+	}
+}
+
+// ReplyTo returns name of the reply queue
+func (b *RPCCeleryBackend) ReplyTo() string {
+	return b.queue
+}
+
+// GetResult returns the latest result of task received so far, it does not block
+// Final results are forgotten once they are returned.
+func (b *RPCCeleryBackend) GetResult(taskID string) (*ResultMessage, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	result, ok := b.results[taskID]
+	if !ok {
+		return nil, ErrResultNotAvailable
+	}
+	if isReadyState(result.Status) {
+		delete(b.results, taskID)
+		delete(b.received, taskID)
+	}
+	return result, nil
+}
+
+// SetResult sends result to the reply queue of this backend
+func (b *RPCCeleryBackend) SetResult(taskID string, result *ResultMessage) error {
+	return b.reply(b.queue, taskID, result)
+}
+
+// SetTaskResult sends result of task to its reply_to
+func (b *RPCCeleryBackend) SetTaskResult(task *CeleryTask, result *ResultMessage) error {
+	if task.ReplyTo == "" {
+		return fmt.Errorf("task %s has no reply_to", task.Id)
+	}
+	return b.reply(task.ReplyTo, task.Id, result)
+}
+
+// reply publishes result to queue through the default exchange
+func (b *RPCCeleryBackend) reply(queue string, taskID string, result *ResultMessage) error {
+	result.ID = taskID
+	serializer, resBytes, err := b.options.encodeResult(result)
+	if err != nil {
+		return err
+	}
+	var headers amqp.Table
+	if b.options.Encryption != "" {
+		headers = amqp.Table{"encryption": b.options.Encryption}
+	}
+	message := amqp.Publishing{
+		Headers:         headers,
+		DeliveryMode:    amqp.Transient,
+		ContentType:     serializer.ContentType(),
+		ContentEncoding: serializer.ContentEncoding(),
+		CorrelationId:   taskID,
+		Body:            resBytes,
+	}
+	return b.session.do(func(channel *amqp.Channel) error {
+		return channel.Publish("", queue, false, false, message)
+	})
+}
+
+// Close closes connection to AMQP server, the reply queue is deleted
+func (b *RPCCeleryBackend) Close() error {
+	return b.session.Close()
+}
@@ -0,0 +1,259 @@
+package gocelery
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// authSeparator separates fields of messages signed by Celery auth serializer
+var authSeparator = []byte("\x00\x01")
+
+// CertStore keeps trusted certificates by their Celery ids
+type CertStore struct {
+	sync.RWMutex
+	certs map[string]*x509.Certificate
+}
+
+// NewCertStore creates empty certificate store
+func NewCertStore() *CertStore {
+	return &CertStore{certs: make(map[string]*x509.Certificate)}
+}
+
+// LoadCertStore creates certificate store from PEM files matching pattern,
+// like security_cert_store setting of Celery
+func LoadCertStore(pattern string) (*CertStore, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	store := NewCertStore()
+	for _, path := range paths {
+		cert, err := loadCertificate(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Add(cert); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return store, nil
+}
+
+// Add adds trusted certificate, expired and duplicate certificates are rejected
+func (s *CertStore) Add(cert *x509.Certificate) error {
+	if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+		return fmt.Errorf("certificate %s has no RSA public key", certificateID(cert))
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("certificate %s has expired", certificateID(cert))
+	}
+	s.Lock()
+	defer s.Unlock()
+	id := certificateID(cert)
+	if _, ok := s.certs[id]; ok {
+		return fmt.Errorf("duplicate certificate %s", id)
+	}
+	s.certs[id] = cert
+	return nil
+}
+
+// Get retrieves certificate by its Celery id
+func (s *CertStore) Get(id string) (*x509.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+	cert, ok := s.certs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown certificate %s", id)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("certificate %s has expired", id)
+	}
+	return cert, nil
+}
+
+// certificateID formats certificate id like Celery: issuer and serial number
+func certificateID(cert *x509.Certificate) string {
+	return fmt.Sprintf("<Name(%s)> %s", cert.Issuer.String(), cert.SerialNumber.String())
+}
+
+// AuthSerializer signs and verifies message bodies like Celery auth serializer
+// Bodies are serialized by inner serializer, signed with RSA-PSS and SHA256
+// and verified against certificates of trusted signers.
+// Register it as "auth" and accept only "auth" content in workers to reject unsigned messages.
+type AuthSerializer struct {
+	key        *rsa.PrivateKey
+	cert       *x509.Certificate
+	store      *CertStore
+	serializer string
+}
+
+// NewAuthSerializer creates AuthSerializer
+// key and cert are used for signing and may be nil if only verification is needed,
+// serializer is name of registered Serializer used for the signed content, json by default.
+func NewAuthSerializer(key *rsa.PrivateKey, cert *x509.Certificate, store *CertStore, serializer string) (*AuthSerializer, error) {
+	if (key == nil) != (cert == nil) {
+		return nil, fmt.Errorf("key and certificate must be both set")
+	}
+	if cert != nil {
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); !ok || pub.N.Cmp(key.N) != 0 {
+			return nil, fmt.Errorf("key does not match certificate %s", certificateID(cert))
+		}
+	}
+	if _, err := GetSerializer(serializer); err != nil {
+		return nil, err
+	}
+	return &AuthSerializer{
+		key:        key,
+		cert:       cert,
+		store:      store,
+		serializer: serializer,
+	}, nil
+}
+
+// LoadAuthSerializer creates AuthSerializer from PEM files,
+// like security_key, security_certificate and security_cert_store settings of Celery
+func LoadAuthSerializer(keyFile, certFile, certStorePattern, serializer string) (*AuthSerializer, error) {
+	key, err := loadPrivateKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadCertificate(certFile)
+	if err != nil {
+		return nil, err
+	}
+	store, err := LoadCertStore(certStorePattern)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuthSerializer(key, cert, store, serializer)
+}
+
+func (s *AuthSerializer) ContentType() string {
+	return "application/data"
+}
+
+func (s *AuthSerializer) ContentEncoding() string {
+	return "utf-8"
+}
+
+func (s *AuthSerializer) Marshal(v interface{}) ([]byte, error) {
+	if s.key == nil {
+		return nil, fmt.Errorf("auth serializer has no signing key")
+	}
+	serializer, err := GetSerializer(s.serializer)
+	if err != nil {
+		return nil, err
+	}
+	body, err := serializer.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// content is signed after serialization, so that it is verified before being decoded
+	hashed := sha256.Sum256(body)
+	signature, err := rsa.SignPSS(rand.Reader, s.key, crypto.SHA256, hashed[:],
+		&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+	if err != nil {
+		return nil, err
+	}
+	fields := bytes.Join([][]byte{
+		[]byte(certificateID(s.cert)),
+		signature,
+		[]byte(serializer.ContentType()),
+		[]byte(serializer.ContentEncoding()),
+		body,
+	}, authSeparator)
+	data := make([]byte, base64.StdEncoding.EncodedLen(len(fields)))
+	base64.StdEncoding.Encode(data, fields)
+	return data, nil
+}
+
+func (s *AuthSerializer) Unmarshal(data []byte, v interface{}) error {
+	if s.store == nil {
+		return fmt.Errorf("auth serializer has no certificate store")
+	}
+	raw := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(raw, data)
+	if err != nil {
+		return err
+	}
+	raw = raw[:n]
+	end := bytes.Index(raw, authSeparator)
+	if end < 0 {
+		return fmt.Errorf("malformed signed message")
+	}
+	cert, err := s.store.Get(string(raw[:end]))
+	if err != nil {
+		return err
+	}
+	// signature may contain the separator, its length is given by the signer key
+	pub := cert.PublicKey.(*rsa.PublicKey)
+	start := end + len(authSeparator)
+	end = start + pub.Size()
+	if end+len(authSeparator) > len(raw) {
+		return fmt.Errorf("malformed signed message")
+	}
+	signature := raw[start:end]
+	fields := bytes.SplitN(raw[end+len(authSeparator):], authSeparator, 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("malformed signed message")
+	}
+	body := fields[2]
+	hashed := sha256.Sum256(body)
+	if err := rsa.VerifyPSS(pub, crypto.SHA256, hashed[:], signature,
+		&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}); err != nil {
+		return fmt.Errorf("bad signature of %s: %v", certificateID(cert), err)
+	}
+	serializer, err := GetSerializer(string(fields[0]))
+	if err != nil {
+		return err
+	}
+	return serializer.Unmarshal(body, v)
+}
+
+// loadCertificate reads PEM encoded certificate
+func loadCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM encoded certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// loadPrivateKey reads PEM encoded PKCS1 or PKCS8 RSA private key
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded private key", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a RSA private key", path)
+	}
+	return rsaKey, nil
+}
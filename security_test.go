@@ -0,0 +1,112 @@
+package gocelery
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates self-signed certificate for signing tests
+func newTestCertificate(t *testing.T, serial int64) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "gocelery", Organization: []string{"gocelery"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return key, cert
+}
+
+func TestAuthSerializer(t *testing.T) {
+	key, cert := newTestCertificate(t, 1)
+	store := NewCertStore()
+	if err := store.Add(cert); err != nil {
+		t.Fatalf("failed to add certificate: %v", err)
+	}
+	if err := store.Add(cert); err == nil {
+		t.Errorf("duplicate certificate was accepted")
+	}
+	if id := certificateID(cert); id != "<Name(CN=gocelery,O=gocelery)> 1" {
+		t.Errorf("unexpected certificate id %s", id)
+	}
+	serializer, err := NewAuthSerializer(key, cert, store, "json")
+	if err != nil {
+		t.Fatalf("failed to create auth serializer: %v", err)
+	}
+	RegisterSerializer("auth", serializer)
+
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend, ClientSerializer("auth"))
+	celeryWorker := NewCeleryWorker(broker, backend, 1, WorkerAcceptContent("auth"))
+	celeryWorker.Register("add", func(a, b int) int { return a + b })
+
+	asyncResult, err := client.Delay("add", 1, 2)
+	if err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	if broker.messages[0].ContentType != "application/data" {
+		t.Errorf("unexpected content type %s", broker.messages[0].ContentType)
+	}
+	celeryWorker.processTask(0)
+	if res, err := asyncResult.AsyncGet(); err != nil || res != float64(3) {
+		t.Errorf("unexpected result %v %v", res, err)
+	}
+
+	// unsigned message is refused
+	unsigned, _ := NewCeleryClient(broker, backend)
+	asyncResult, _ = unsigned.Delay("add", 1, 2)
+	celeryWorker.processTask(0)
+	if _, err := asyncResult.AsyncGet(); err == nil {
+		t.Errorf("unsigned task was run")
+	}
+
+	// tampered message cannot be decoded
+	client.Delay("add", 1, 2)
+	msg := broker.messages[0]
+	outer, _ := base64.StdEncoding.DecodeString(msg.Body)
+	signed, _ := base64.StdEncoding.DecodeString(string(outer))
+	signed[len(signed)-5] = '9'
+	msg.Body = base64.StdEncoding.EncodeToString([]byte(base64.StdEncoding.EncodeToString(signed)))
+	if task := Msg2Task(msg); task != nil {
+		t.Errorf("tampered task was decoded: %v", task.Args)
+	}
+}
+
+func TestAuthSerializerUnknownSigner(t *testing.T) {
+	key, cert := newTestCertificate(t, 2)
+	_, trusted := newTestCertificate(t, 3)
+	store := NewCertStore()
+	store.Add(trusted)
+	serializer, err := NewAuthSerializer(key, cert, store, "json")
+	if err != nil {
+		t.Fatalf("failed to create auth serializer: %v", err)
+	}
+	data, err := serializer.Marshal([]interface{}{"a"})
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	var v interface{}
+	if err := serializer.Unmarshal(data, &v); err == nil {
+		t.Errorf("message of unknown signer was accepted")
+	}
+	if _, err := NewAuthSerializer(key, trusted, store, "json"); err == nil {
+		t.Errorf("key not matching certificate was accepted")
+	}
+}
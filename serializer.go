@@ -0,0 +1,183 @@
+package gocelery
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+	"gopkg.in/yaml.v2"
+)
+
+// Serializer encodes and decodes task bodies and results, like kombu serializers
+type Serializer interface {
+	// ContentType is sent as content-type of encoded data
+	ContentType() string
+	// ContentEncoding is sent as content-encoding of encoded data
+	ContentEncoding() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// serializerRegistry keeps serializers by name and by content type
+var serializerRegistry = struct {
+	sync.RWMutex
+	byName        map[string]Serializer
+	byContentType map[string]Serializer
+}{
+	byName:        make(map[string]Serializer),
+	byContentType: make(map[string]Serializer),
+}
+
+// RegisterSerializer registers serializer by name and by its content type,
+// replacing any serializer previously registered with the same name or content type
+func RegisterSerializer(name string, serializer Serializer) {
+	serializerRegistry.Lock()
+	defer serializerRegistry.Unlock()
+	serializerRegistry.byName[name] = serializer
+	serializerRegistry.byContentType[serializer.ContentType()] = serializer
+}
+
+// GetSerializer retrieves registered serializer by name or content type
+// Empty name returns the default json serializer.
+func GetSerializer(name string) (Serializer, error) {
+	if name == "" {
+		name = "json"
+	}
+	serializerRegistry.RLock()
+	defer serializerRegistry.RUnlock()
+	if serializer, ok := serializerRegistry.byName[name]; ok {
+		return serializer, nil
+	}
+	if serializer, ok := serializerRegistry.byContentType[name]; ok {
+		return serializer, nil
+	}
+	return nil, fmt.Errorf("unsupported serializer %s", name)
+}
+
+func init() {
+	RegisterSerializer("json", &jsonSerializer{})
+	RegisterSerializer("msgpack", &msgpackSerializer{})
+	RegisterSerializer("yaml", &yamlSerializer{})
+}
+
+// jsonSerializer is the default serializer of Celery
+type jsonSerializer struct{}
+
+func (s *jsonSerializer) ContentType() string {
+	return "application/json"
+}
+
+func (s *jsonSerializer) ContentEncoding() string {
+	return "utf-8"
+}
+
+func (s *jsonSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (s *jsonSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackSerializer is compatible with Python msgpack, json field tags are honored
+type msgpackSerializer struct{}
+
+func (s *msgpackSerializer) ContentType() string {
+	return "application/x-msgpack"
+}
+
+func (s *msgpackSerializer) ContentEncoding() string {
+	return "binary"
+}
+
+func (s *msgpackSerializer) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := msgpack.NewEncoder(&buf).UseJSONTag(true).UseCompactEncoding(true).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (s *msgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).UseDecodeInterfaceLoose(true)
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	normalizeDecoded(v)
+	return nil
+}
+
+// yamlSerializer is compatible with Python yaml.safe_dump
+// Values are converted through json so that json field tags are honored.
+type yamlSerializer struct{}
+
+func (s *yamlSerializer) ContentType() string {
+	return "application/x-yaml"
+}
+
+func (s *yamlSerializer) ContentEncoding() string {
+	return "utf-8"
+}
+
+func (s *yamlSerializer) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
+
+func (s *yamlSerializer) Unmarshal(data []byte, v interface{}) error {
+	var generic interface{}
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	data, err := json.Marshal(normalizeValue(generic))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// normalizeDecoded normalizes generic values decoded into v
+func normalizeDecoded(v interface{}) {
+	switch ptr := v.(type) {
+	case *interface{}:
+		*ptr = normalizeValue(*ptr)
+	case *[]interface{}:
+		for i := range *ptr {
+			(*ptr)[i] = normalizeValue((*ptr)[i])
+		}
+	case *map[string]interface{}:
+		for k, val := range *ptr {
+			(*ptr)[k] = normalizeValue(val)
+		}
+	}
+}
+
+// normalizeValue converts maps with non-string keys into map[string]interface{} recursively,
+// so that values decoded by any serializer look like those decoded from json
+func normalizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, elem := range val {
+			m[fmt.Sprint(k)] = normalizeValue(elem)
+		}
+		return m
+	case map[string]interface{}:
+		for k, elem := range val {
+			val[k] = normalizeValue(elem)
+		}
+		return val
+	case []interface{}:
+		for i, elem := range val {
+			val[i] = normalizeValue(elem)
+		}
+		return val
+	}
+	return v
+}
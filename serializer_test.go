@@ -0,0 +1,70 @@
+package gocelery
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestSerializerBody(t *testing.T) {
+	for _, name := range []string{"json", "msgpack", "yaml"} {
+		serializer, err := GetSerializer(name)
+		if err != nil {
+			t.Fatalf("serializer %s is not registered: %v", name, err)
+		}
+		task := &CeleryTask{
+			Id:         generateUUID(),
+			Task:       "add",
+			Args:       []interface{}{"a", float64(1)},
+			Kwargs:     map[string]interface{}{"nested": map[string]interface{}{"b": []interface{}{"c"}}},
+			Serializer: name,
+		}
+		msg := task2Headers(task)
+		if err := encodeMessageBody(task, msg); err != nil {
+			t.Fatalf("failed to encode %s body: %v", name, err)
+		}
+		if msg.ContentType != serializer.ContentType() {
+			t.Errorf("unexpected content type %s for %s", msg.ContentType, name)
+		}
+		decoded := Msg2Task(msg)
+		if decoded == nil {
+			t.Fatalf("failed to decode %s message", name)
+		}
+		if decoded.Serializer != serializer.ContentType() {
+			t.Errorf("unexpected serializer %s for %s", decoded.Serializer, name)
+		}
+		if len(decoded.Args) != 2 || decoded.Args[0] != "a" {
+			t.Errorf("unexpected %s args %#v", name, decoded.Args)
+		}
+		if !reflect.DeepEqual(decoded.Kwargs["nested"], task.Kwargs["nested"]) {
+			t.Errorf("unexpected %s kwargs %#v", name, decoded.Kwargs)
+		}
+		releaseCeleryMessage(msg)
+	}
+}
+
+func TestSerializerPythonYAML(t *testing.T) {
+	// body produced by kombu yaml serializer
+	body := "- [2, 3]\n- {key: value}\n- {callbacks: null, chain: null, chord: null, errbacks: null}\n"
+	serializer, _ := GetSerializer("application/x-yaml")
+	pythonBody, err := DecodeBodyAs(base64.StdEncoding.EncodeToString([]byte(body)), serializer)
+	if err != nil {
+		t.Fatalf("failed to decode yaml body: %v", err)
+	}
+	if len(pythonBody.Args) != 2 || pythonBody.Kwargs["key"] != "value" {
+		t.Errorf("unexpected body %#v", pythonBody)
+	}
+}
+
+func TestSerializerUnsupported(t *testing.T) {
+	if _, err := GetSerializer("application/x-python-serialize"); err == nil {
+		t.Errorf("pickle serializer should not be supported")
+	}
+	task := &CeleryTask{Id: generateUUID(), Task: "add"}
+	msg := Task2Msg(task)
+	msg.ContentType = "application/x-python-serialize"
+	if decoded := Msg2Task(msg); decoded != nil {
+		t.Errorf("message with unsupported content type was decoded")
+	}
+	releaseCeleryMessage(msg)
+}
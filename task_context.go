@@ -0,0 +1,170 @@
+package gocelery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// TaskContext is execution context of a task run by the worker
+// Function tasks receive it when their first parameter is *TaskContext,
+// Itf_CeleryTask implementations when they implement ContextualTask.
+type TaskContext struct {
+	// Task is the request of the running task: its id, arguments, retries, headers,
+	// delivery info, ETA and so on
+	Task *CeleryTask
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	client   *CeleryClient
+	backend  CeleryBackend
+	lock     sync.Mutex
+	children []string
+}
+
+// ContextualTask is Itf_CeleryTask receiving TaskContext, RunTaskWithContext is called
+// instead of RunTask. The context is passed rather than stored, as the registered instance
+// is shared by all worker goroutines.
+type ContextualTask interface {
+	Itf_CeleryTask
+	RunTaskWithContext(ctx *TaskContext) (interface{}, error)
+}
+
+var taskContextType = reflect.TypeOf((*TaskContext)(nil))
+
+func newTaskContext(task *CeleryTask, client *CeleryClient, backend CeleryBackend) *TaskContext {
+	c := &TaskContext{
+		Task:    task,
+		client:  client,
+		backend: backend,
+	}
+	if task.TimeLimit > 0 {
+		c.ctx, c.cancel = context.WithTimeout(context.Background(), task.TimeLimit)
+	} else {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	return c
+}
+
+// Context returns context of the running task, it is done when the task returns
+// or its hard time limit is exceeded
+func (c *TaskContext) Context() context.Context {
+	return c.ctx
+}
+
+// Client returns client sending subtasks of the running task
+// Their parent_id and root_id headers are set and they are recorded
+// as children in result of the running task.
+func (c *TaskContext) Client() *CeleryClient {
+	client := *c.client
+	client.interceptors = append([]PublishInterceptor{c.linkChild}, c.client.interceptors...)
+	return &client
+}
+
+// Delay sends subtask of the running task
+func (c *TaskContext) Delay(task string, args ...interface{}) (*AsyncResult, error) {
+	return c.Client().Delay(task, args...)
+}
+
+// DelayKwargs sends subtask of the running task with argument map
+func (c *TaskContext) DelayKwargs(task string, args map[string]interface{}) (*AsyncResult, error) {
+	return c.Client().DelayKwargs(task, args)
+}
+
+// Retry sends the running task again to be run after countdown, with the same id and arguments
+// and retries incremented. The returned error must be returned by the task, so that its
+// state is RETRY. If the task was already retried maxRetries times, cause is returned instead
+// and the task fails; negative maxRetries means no limit.
+func (c *TaskContext) Retry(cause error, countdown time.Duration, maxRetries int) error {
+	if maxRetries >= 0 && c.Task.Retries >= maxRetries {
+		return cause
+	}
+	// the retry is released to the pool of task messages once it is sent
+	retry := getTaskObj(c.Task.Task)
+	retry.Id = c.Task.Id
+	retry.Args = c.Task.Args
+	retry.Kwargs = c.Task.Kwargs
+	retry.Retries = c.Task.Retries + 1
+	retry.ETA = time.Now().Add(countdown).UTC()
+	retry.Expires = c.Task.Expires
+	retry.Priority = c.Task.Priority
+	retry.Embed = c.Task.Embed
+	retry.Headers = c.Task.Headers
+	retry.Serializer = c.Task.Serializer
+	retry.Compression = c.Task.Compression
+	retry.Encryption = c.Task.Encryption
+	retry.Protocol = c.Task.Protocol
+	retry.Shadow = c.Task.Shadow
+	retry.ArgsRepr = c.Task.ArgsRepr
+	retry.KwargsRepr = c.Task.KwargsRepr
+	retry.TimeLimit = c.Task.TimeLimit
+	retry.SoftTimeLimit = c.Task.SoftTimeLimit
+	retry.RootId = c.Task.RootId
+	retry.ParentId = c.Task.ParentId
+	retry.ReplyTo = c.Task.ReplyTo
+	eta := retry.ETA
+	if _, err := c.client.delay(retry, c.Task.DeliveryInfo); err != nil {
+		return fmt.Errorf("failed to retry task: %v", err)
+	}
+	return &RetryError{Cause: cause, ETA: eta}
+}
+
+// UpdateState stores custom state of the running task with its meta, e.g. PROGRESS with
+// {"current": 1, "total": 10}. It is replaced by the final result when the task returns.
+func (c *TaskContext) UpdateState(state string, meta interface{}) error {
+	return setTaskResult(c.backend, c.Task, &ResultMessage{
+		ID:     c.Task.Id,
+		Status: state,
+		Result: meta,
+	})
+}
+
+// Children returns ids of subtasks sent so far
+func (c *TaskContext) Children() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.children...)
+}
+
+// linkChild is publish interceptor linking sent task to the running task
+func (c *TaskContext) linkChild(task *CeleryTask, message *CeleryMessage, next PublishHandler) error {
+	task.ParentId = c.Task.Id
+	task.RootId = c.Task.RootId
+	if task.RootId == "" {
+		task.RootId = c.Task.Id
+	}
+	message.Headers.ParentId = task.ParentId
+	message.Headers.RootId = task.RootId
+	if err := next(task, message); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.children = append(c.children, task.Id)
+	c.lock.Unlock()
+	return nil
+}
+
+// resultChildren formats children like Celery result tuples: [[id, parent], null]
+func (c *TaskContext) resultChildren() []interface{} {
+	children := c.Children()
+	if len(children) == 0 {
+		return nil
+	}
+	tuples := make([]interface{}, len(children))
+	for i, id := range children {
+		tuples[i] = []interface{}{[]interface{}{id, nil}, nil}
+	}
+	return tuples
+}
+
+// RetryError is returned by TaskContext.Retry, the running task is stored in RETRY state
+type RetryError struct {
+	Cause error
+	ETA   time.Time
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("Retry in %s: %v", e.ETA.Sub(time.Now()).Round(time.Second), e.Cause)
+}
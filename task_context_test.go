@@ -0,0 +1,334 @@
+package gocelery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTaskContextSubtasks(t *testing.T) {
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend)
+	celeryWorker := NewCeleryWorker(broker, backend, 1)
+	celeryWorker.Register("parent", func(ctx *TaskContext, n int) (int, error) {
+		for i := 0; i < n; i++ {
+			if _, err := ctx.Client().Delay("child"); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	})
+	celeryWorker.Register("child", func(ctx *TaskContext) {
+		ctx.Client().Delay("leaf")
+	})
+	if err := celeryWorker.RegisterWithParams("leaf", func(ctx *TaskContext, name string) string {
+		return name
+	}, "name"); err != nil {
+		t.Fatalf("failed to register task with context: %v", err)
+	}
+
+	asyncResult, _ := client.Delay("parent", 2)
+	root := broker.messages[0].Headers
+	if root.RootId != asyncResult.GetTaskId() || root.ParentId != "" {
+		t.Errorf("unexpected ids of root task: %s %s", root.RootId, root.ParentId)
+	}
+	runMemoryTask(t, celeryWorker, broker, backend)
+	if len(broker.messages) != 2 {
+		t.Fatalf("subtasks were not sent")
+	}
+	for _, msg := range broker.messages {
+		if msg.Headers.ParentId != root.TaskId || msg.Headers.RootId != root.TaskId {
+			t.Errorf("unexpected ids of child task: %s %s", msg.Headers.RootId, msg.Headers.ParentId)
+		}
+	}
+	child := broker.messages[0].Headers
+	result, err := backend.GetResult(root.TaskId)
+	if err != nil {
+		t.Fatalf("failed to get result: %v", err)
+	}
+	if len(result.Children) != 2 {
+		t.Fatalf("unexpected children %v", result.Children)
+	}
+	tuple := result.Children[0].([]interface{})
+	if tuple[0].([]interface{})[0] != child.TaskId || tuple[1] != nil {
+		t.Errorf("unexpected child tuple %v", tuple)
+	}
+
+	runMemoryTask(t, celeryWorker, broker, backend)
+	leaf := broker.messages[len(broker.messages)-1].Headers
+	if leaf.ParentId != child.TaskId || leaf.RootId != root.TaskId {
+		t.Errorf("unexpected ids of grandchild task: %s %s", leaf.RootId, leaf.ParentId)
+	}
+	task, _ := broker.GetTask()
+	if task.ParentId != root.TaskId || task.RootId != root.TaskId {
+		t.Errorf("ids were not decoded: %s %s", task.RootId, task.ParentId)
+	}
+}
+
+func TestTaskContextRequest(t *testing.T) {
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend)
+	celeryWorker := NewCeleryWorker(broker, backend, 1)
+	var request *CeleryTask
+	var taskContext context.Context
+	celeryWorker.Register("inspect", func(ctx *TaskContext) {
+		request = ctx.Task
+		taskContext = ctx.Context()
+		if _, ok := taskContext.Deadline(); !ok {
+			t.Errorf("time limit was not applied to context")
+		}
+	})
+	asyncResult, _ := client.ApplyAsync("inspect", nil, nil, nil, nil, false, "", 0, "", "",
+		ApplyTimeLimit(time.Minute, 0))
+	runMemoryTask(t, celeryWorker, broker, backend)
+	if request.Id != asyncResult.GetTaskId() || request.Retries != 0 || request.DeliveryInfo.RoutingKey != "celery" {
+		t.Errorf("unexpected request %v", request)
+	}
+	if taskContext.Err() == nil {
+		t.Errorf("context was not cancelled after task returned")
+	}
+}
+
+func TestTaskContextRetry(t *testing.T) {
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend)
+	celeryWorker := NewCeleryWorker(broker, backend, 1)
+	celeryWorker.Register("flaky", func(ctx *TaskContext, url string) error {
+		return ctx.Retry(fmt.Errorf("%s is unavailable", url), time.Second, 1)
+	})
+	asyncResult, _ := client.Delay("flaky", "http://example.com")
+	runMemoryTask(t, celeryWorker, broker, backend)
+	result, _ := backend.GetResult(asyncResult.GetTaskId())
+	if result.Status != StateRetry {
+		t.Errorf("unexpected state %s", result.Status)
+	}
+	retry := broker.messages[0]
+	if retry.Headers.TaskId != asyncResult.GetTaskId() || retry.Headers.Retries != 1 || retry.Headers.ETA.Before(time.Now()) {
+		t.Errorf("unexpected retry %v", retry.Headers)
+	}
+	runMemoryTask(t, celeryWorker, broker, backend)
+	result, _ = backend.GetResult(asyncResult.GetTaskId())
+	if result.Status != StateFailure || len(broker.messages) != 0 {
+		t.Errorf("task was retried more than once: %s", result.Status)
+	}
+}
+
+// TestTaskContextRetryReleased checks retried task does not leak into tasks sent later
+func TestTaskContextRetryReleased(t *testing.T) {
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend)
+	celeryWorker := NewCeleryWorker(broker, backend, 1)
+	celeryWorker.Register("flaky", func(ctx *TaskContext) error {
+		return ctx.Retry(fmt.Errorf("unavailable"), time.Hour, -1)
+	})
+	client.ApplyAsync("flaky", nil, nil, nil, nil, false, "", 7, "", "")
+	runMemoryTask(t, celeryWorker, broker, backend)
+	for i := 0; i < 3; i++ {
+		client.Delay("other")
+	}
+	for _, message := range broker.messages[1:] {
+		if message.Headers.Retries != 0 || message.Headers.ETA.After(time.Now()) || message.Properties.Priority != 0 {
+			t.Errorf("task %s sent with retries %d, eta %v and priority %d", message.Headers.Task,
+				message.Headers.Retries, message.Headers.ETA, message.Properties.Priority)
+		}
+	}
+}
+
+// progressTask is Itf_CeleryTask reporting its progress
+type progressTask struct {
+	total int
+}
+
+func (p *progressTask) ParseKwargs(kwargs map[string]interface{}) error {
+	p.total = int(kwargs["total"].(float64))
+	return nil
+}
+
+func (p *progressTask) RunTask() (interface{}, error) {
+	return nil, fmt.Errorf("context is required")
+}
+
+func (p *progressTask) RunTaskWithContext(ctx *TaskContext) (interface{}, error) {
+	for i := 0; i < p.total; i++ {
+		if err := ctx.UpdateState("PROGRESS", map[string]interface{}{"current": i, "total": p.total}); err != nil {
+			return nil, err
+		}
+	}
+	result, err := ctx.backend.GetResult(ctx.Task.Id)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func TestTaskContextItf(t *testing.T) {
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend)
+	celeryWorker := NewCeleryWorker(broker, backend, 1)
+	celeryWorker.Register("import", &progressTask{})
+	client.DelayKwargs("import", map[string]interface{}{"total": float64(3)})
+	task, _ := broker.GetTask()
+	resultMsg, err := celeryWorker.RunTask(task)
+	if err != nil {
+		t.Fatalf("failed to run task: %v", err)
+	}
+	progress := resultMsg.Result.(*ResultMessage)
+	meta := progress.Result.(map[string]interface{})
+	if progress.Status != "PROGRESS" || meta["current"] != float64(2) {
+		t.Errorf("unexpected progress %s %v", progress.Status, meta)
+	}
+}
+
+// idTask is ContextualTask returning id of the running task
+type idTask struct{}
+
+func (idTask) ParseKwargs(kwargs map[string]interface{}) error {
+	return nil
+}
+
+func (idTask) RunTask() (interface{}, error) {
+	return nil, fmt.Errorf("context is required")
+}
+
+func (idTask) RunTaskWithContext(ctx *TaskContext) (interface{}, error) {
+	time.Sleep(10 * time.Millisecond)
+	return ctx.Task.Id, nil
+}
+
+// TestTaskContextConcurrent checks concurrent runs of the same task get their own context
+func TestTaskContextConcurrent(t *testing.T) {
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend)
+	celeryWorker := NewCeleryWorker(broker, backend, 8)
+	celeryWorker.Register("id", &idTask{})
+	var tasks []*CeleryTask
+	for i := 0; i < 8; i++ {
+		client.Delay("id")
+		task, _ := broker.GetTask()
+		tasks = append(tasks, task)
+	}
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task *CeleryTask) {
+			defer wg.Done()
+			result, err := celeryWorker.RunTask(task)
+			if err != nil || result.Result != task.Id {
+				t.Errorf("task %s got result %v: %v", task.Id, result.Result, err)
+			}
+		}(task)
+	}
+	wg.Wait()
+}
+
+func TestAsyncResultState(t *testing.T) {
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend)
+	celeryWorker := NewCeleryWorker(broker, backend, 1)
+	updated, proceed := make(chan struct{}), make(chan struct{})
+	celeryWorker.Register("import", func(ctx *TaskContext, total int) (int, error) {
+		if err := ctx.UpdateState("PROGRESS", map[string]interface{}{"current": 1, "total": total}); err != nil {
+			return 0, err
+		}
+		close(updated)
+		<-proceed
+		return total, nil
+	})
+	asyncResult, err := client.Delay("import", 10)
+	if err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	if state, err := asyncResult.State(); err != nil || state != StatePending {
+		t.Errorf("unexpected state %s before task runs: %v", state, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runMemoryTask(t, celeryWorker, broker, backend)
+	}()
+	<-updated
+	if state, err := asyncResult.State(); err != nil || state != "PROGRESS" {
+		t.Errorf("unexpected state %s: %v", state, err)
+	}
+	info, err := asyncResult.Info()
+	if meta, ok := info.(map[string]interface{}); err != nil || !ok || meta["current"] != float64(1) || meta["total"] != float64(10) {
+		t.Errorf("unexpected info %v: %v", info, err)
+	}
+	if ready, err := asyncResult.Ready(); err != nil || ready {
+		t.Errorf("task in custom state must not be ready: %v", err)
+	}
+	if _, err := asyncResult.AsyncGet(); err != ErrResultNotAvailable {
+		t.Errorf("unexpected error getting result of running task: %v", err)
+	}
+	close(proceed)
+	<-done
+	if res, err := asyncResult.Get(time.Second); err != nil || res != float64(10) {
+		t.Errorf("unexpected result %v: %v", res, err)
+	}
+	if state, err := asyncResult.State(); err != nil || state != StateSuccess {
+		t.Errorf("unexpected state %s after task returned: %v", state, err)
+	}
+}
+
+func TestAsyncResultFailure(t *testing.T) {
+	backend := newMemoryBackend()
+	backend.SetResult("failed", getFailureResultMessage(fmt.Errorf("division by zero"), nil))
+	asyncResult := &AsyncResult{taskID: "failed", backend: backend}
+	start := time.Now()
+	if _, err := asyncResult.Get(5 * time.Second); err == nil || time.Since(start) > time.Second {
+		t.Errorf("failure must be returned without waiting for timeout: %v", err)
+	}
+	if state, _ := asyncResult.State(); state != StateFailure {
+		t.Errorf("unexpected state %s", state)
+	}
+}
+
+// notifyingBackend is memoryBackend notifying waiting results
+type notifyingBackend struct {
+	*memoryBackend
+	waiters map[string]chan struct{}
+}
+
+func (b *notifyingBackend) SetResult(taskID string, result *ResultMessage) error {
+	b.memoryBackend.SetResult(taskID, result)
+	b.Lock()
+	defer b.Unlock()
+	if notify, ok := b.waiters[taskID]; ok {
+		notify <- struct{}{}
+	}
+	return nil
+}
+
+func (b *notifyingBackend) WaitResult(taskID string) (<-chan struct{}, func(), error) {
+	b.Lock()
+	defer b.Unlock()
+	notify := make(chan struct{}, 1)
+	b.waiters[taskID] = notify
+	return notify, func() {
+		b.Lock()
+		defer b.Unlock()
+		delete(b.waiters, taskID)
+	}, nil
+}
+
+func TestAsyncResultNotify(t *testing.T) {
+	backend := &notifyingBackend{newMemoryBackend(), make(map[string]chan struct{})}
+	asyncResult := &AsyncResult{taskID: "notified", backend: backend}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		backend.SetResult("notified", getResultMessage(3))
+	}()
+	start := time.Now()
+	if res, err := asyncResult.Get(5 * time.Second); err != nil || res != float64(3) {
+		t.Errorf("unexpected result %v: %v", res, err)
+	}
+	// polling would wait a second
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("result received after %v", elapsed)
+	}
+	if len(backend.waiters) != 0 {
+		t.Errorf("waiting is not cancelled")
+	}
+}
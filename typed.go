@@ -0,0 +1,200 @@
+package gocelery
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// TaskRegistry registers tasks, it is implemented by CeleryWorker and CeleryServer
+type TaskRegistry interface {
+	Register(name string, task interface{})
+}
+
+// TaskDef is a type-safe task definition shared by clients and workers
+//
+// Struct arguments (except those implementing json.Marshaler, like time.Time) are sent as kwargs
+// keyed by their json field names, any other type is sent as a single positional argument.
+// Workers also accept struct arguments from positional args, which are assigned to fields in order.
+type TaskDef[A any, R any] struct {
+	Name string
+}
+
+// NewTaskDef creates new TaskDef
+func NewTaskDef[A any, R any](name string) *TaskDef[A, R] {
+	return &TaskDef[A, R]{Name: name}
+}
+
+// Register registers fn as implementation of the task
+func (d *TaskDef[A, R]) Register(registry TaskRegistry, fn func(A) (R, error)) {
+	registry.Register(d.Name, &typedTask[A, R]{fn: fn})
+}
+
+// Delay sends the task with args and returns typed asynchronous result
+func (d *TaskDef[A, R]) Delay(client *CeleryClient, args A) (*TypedAsyncResult[R], error) {
+	taskArgs, taskKwargs, err := encodeTypedArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	celeryTask := getTaskObj(d.Name)
+	if taskArgs != nil {
+		celeryTask.Args = taskArgs
+	}
+	if taskKwargs != nil {
+		celeryTask.Kwargs = taskKwargs
+	}
+	asyncResult, err := client.delay(celeryTask, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedAsyncResult[R]{asyncResult}, nil
+}
+
+// TypedAsyncResult is pending result decoded into R
+type TypedAsyncResult[R any] struct {
+	*AsyncResult
+}
+
+// Get gets actual result and decodes it into R
+// It blocks for period of time set by timeout and return error if unavailable
+func (ar *TypedAsyncResult[R]) Get(timeout time.Duration) (R, error) {
+	val, err := ar.AsyncResult.Get(timeout)
+	if err != nil {
+		var zero R
+		return zero, err
+	}
+	return decodeTypedValue[R](val)
+}
+
+// AsyncGet gets actual result decoded into R and returns error if not available
+func (ar *TypedAsyncResult[R]) AsyncGet() (R, error) {
+	val, err := ar.AsyncResult.AsyncGet()
+	if err != nil {
+		var zero R
+		return zero, err
+	}
+	return decodeTypedValue[R](val)
+}
+
+// taskRunner is implemented by registered tasks that decode message arguments themselves
+type taskRunner interface {
+	run(message *CeleryTask) (*ResultMessage, error)
+}
+
+// typedTask is registered implementation of TaskDef
+type typedTask[A any, R any] struct {
+	fn func(A) (R, error)
+}
+
+func (t *typedTask[A, R]) run(message *CeleryTask) (*ResultMessage, error) {
+	args, err := decodeTypedArgs[A](message.Args, message.Kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("task %s: %v", message.Task, err)
+	}
+	val, err := t.fn(args)
+	if err != nil {
+		return getFailureResultMessage(err, nil), nil
+	}
+	return getResultMessage(val), nil
+}
+
+// jsonMarshaler is the same as json.Marshaler
+type jsonMarshaler interface {
+	MarshalJSON() ([]byte, error)
+}
+
+var jsonMarshalerType = reflect.TypeOf((*jsonMarshaler)(nil)).Elem()
+
+// isKwargsType checks if typed task arguments of type t are sent as kwargs
+func isKwargsType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	return !t.Implements(jsonMarshalerType) && !reflect.PtrTo(t).Implements(jsonMarshalerType)
+}
+
+// jsonFieldNames returns json names of exported fields of struct type t in declaration order
+func jsonFieldNames(t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// encodeTypedArgs converts typed arguments into celery args or kwargs
+func encodeTypedArgs(args interface{}) ([]interface{}, map[string]interface{}, error) {
+	if args == nil || !isKwargsType(reflect.TypeOf(args)) {
+		return []interface{}{args}, nil, nil
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	var kwargs map[string]interface{}
+	if err := json.Unmarshal(data, &kwargs); err != nil {
+		return nil, nil, err
+	}
+	return nil, kwargs, nil
+}
+
+// decodeTypedArgs converts celery args and kwargs into typed arguments
+func decodeTypedArgs[A any](args []interface{}, kwargs map[string]interface{}) (A, error) {
+	var typed A
+	t := reflect.TypeOf(&typed).Elem()
+	if !isKwargsType(t) {
+		if len(args) != 1 || len(kwargs) != 0 {
+			return typed, fmt.Errorf("expected exactly 1 positional argument, got %d args and %d kwargs", len(args), len(kwargs))
+		}
+		return decodeTypedValue[A](args[0])
+	}
+	names := jsonFieldNames(t)
+	if len(args) > len(names) {
+		return typed, fmt.Errorf("expected at most %d positional arguments, got %d", len(names), len(args))
+	}
+	fields := make(map[string]interface{}, len(args)+len(kwargs))
+	for k, v := range kwargs {
+		fields[k] = v
+	}
+	for i, arg := range args {
+		if _, ok := fields[names[i]]; ok {
+			return typed, fmt.Errorf("got multiple values for argument %s", names[i])
+		}
+		fields[names[i]] = arg
+	}
+	return decodeTypedValue[A](fields)
+}
+
+// decodeTypedValue converts decoded json value into R
+func decodeTypedValue[R any](val interface{}) (R, error) {
+	var typed R
+	if v, ok := val.(R); ok {
+		return v, nil
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return typed, err
+	}
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return typed, fmt.Errorf("cannot decode %v into %T: %v", val, typed, err)
+	}
+	return typed, nil
+}
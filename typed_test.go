@@ -0,0 +1,169 @@
+package gocelery
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryBackend is in-memory CeleryBackend for testing
+type memoryBackend struct {
+	sync.Mutex
+	results map[string]*ResultMessage
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{results: make(map[string]*ResultMessage)}
+}
+
+func (b *memoryBackend) GetResult(taskID string) (*ResultMessage, error) {
+	b.Lock()
+	defer b.Unlock()
+	result, ok := b.results[taskID]
+	if !ok {
+		return nil, ErrResultNotAvailable
+	}
+	// simulate json round trip of backends
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	var resultMessage ResultMessage
+	if err := json.Unmarshal(data, &resultMessage); err != nil {
+		return nil, err
+	}
+	return &resultMessage, nil
+}
+
+func (b *memoryBackend) SetResult(taskID string, result *ResultMessage) error {
+	b.Lock()
+	defer b.Unlock()
+	copied := *result
+	b.results[taskID] = &copied
+	return nil
+}
+
+type divideArgs struct {
+	Dividend int `json:"dividend"`
+	Divisor  int `json:"divisor"`
+}
+
+type divideResult struct {
+	Quotient  int `json:"quotient"`
+	Remainder int `json:"remainder"`
+}
+
+var divideTask = NewTaskDef[divideArgs, divideResult]("divide")
+
+func divide(args divideArgs) (divideResult, error) {
+	if args.Divisor == 0 {
+		return divideResult{}, fmt.Errorf("division by zero")
+	}
+	return divideResult{args.Dividend / args.Divisor, args.Dividend % args.Divisor}, nil
+}
+
+// runMemoryTask runs next task from broker and stores its result in backend
+func runMemoryTask(t *testing.T, celeryWorker *CeleryWorker, broker *memoryBroker, backend CeleryBackend) {
+	task, err := broker.GetTask()
+	if err != nil || task == nil {
+		t.Fatalf("failed to get task: %v", err)
+	}
+	resultMsg, err := celeryWorker.RunTask(task)
+	if err != nil {
+		t.Fatalf("failed to run task: %v", err)
+	}
+	if err := backend.SetResult(task.Id, resultMsg); err != nil {
+		t.Fatalf("failed to set result: %v", err)
+	}
+}
+
+func TestTypedTask(t *testing.T) {
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend)
+	celeryWorker := NewCeleryWorker(broker, backend, 1)
+	divideTask.Register(celeryWorker, divide)
+
+	asyncResult, err := divideTask.Delay(client, divideArgs{Dividend: 17, Divisor: 5})
+	if err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	if len(broker.messages) != 1 {
+		t.Fatalf("task was not sent")
+	}
+	runMemoryTask(t, celeryWorker, broker, backend)
+	res, err := asyncResult.Get(time.Second)
+	if err != nil {
+		t.Fatalf("failed to get result: %v", err)
+	}
+	if res != (divideResult{3, 2}) {
+		t.Errorf("unexpected result %v", res)
+	}
+}
+
+func TestTypedTaskFailure(t *testing.T) {
+	broker, backend := &memoryBroker{}, newMemoryBackend()
+	client, _ := NewCeleryClient(broker, backend)
+	celeryWorker := NewCeleryWorker(broker, backend, 1)
+	divideTask.Register(celeryWorker, divide)
+
+	asyncResult, err := divideTask.Delay(client, divideArgs{Dividend: 1})
+	if err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	runMemoryTask(t, celeryWorker, broker, backend)
+	if _, err := asyncResult.AsyncGet(); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestTypedTaskPositionalArgs(t *testing.T) {
+	celeryWorker := NewCeleryWorker(nil, nil, 1)
+	divideTask.Register(celeryWorker, divide)
+	resultMsg, err := celeryWorker.RunTask(&CeleryTask{
+		Id:     generateUUID(),
+		Task:   divideTask.Name,
+		Args:   []interface{}{float64(9)},
+		Kwargs: map[string]interface{}{"divisor": float64(2)},
+	})
+	if err != nil {
+		t.Fatalf("failed to run task: %v", err)
+	}
+	if resultMsg.Result != (divideResult{4, 1}) {
+		t.Errorf("unexpected result %v", resultMsg.Result)
+	}
+	_, err = celeryWorker.RunTask(&CeleryTask{
+		Id:     generateUUID(),
+		Task:   divideTask.Name,
+		Args:   []interface{}{float64(9)},
+		Kwargs: map[string]interface{}{"dividend": float64(2)},
+	})
+	if err == nil {
+		t.Errorf("duplicate argument was accepted")
+	}
+}
+
+func TestTypedTaskScalarArgs(t *testing.T) {
+	broker := &memoryBroker{}
+	client, _ := NewCeleryClient(broker, nil)
+	celeryWorker := NewCeleryWorker(broker, nil, 1)
+	countTask := NewTaskDef[[]string, int]("count")
+	countTask.Register(celeryWorker, func(words []string) (int, error) {
+		return len(words), nil
+	})
+	if _, err := countTask.Delay(client, []string{"a", "b", "c"}); err != nil {
+		t.Fatalf("failed to send task: %v", err)
+	}
+	task, _ := broker.GetTask()
+	if len(task.Args) != 1 {
+		t.Fatalf("scalar argument was not sent positionally: %v", task.Args)
+	}
+	resultMsg, err := celeryWorker.RunTask(task)
+	if err != nil {
+		t.Fatalf("failed to run task: %v", err)
+	}
+	if resultMsg.Result != 3 {
+		t.Errorf("unexpected result %v", resultMsg.Result)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"time"
 )
 
 // CeleryWorker represents distributed task worker
@@ -13,24 +15,119 @@ type CeleryWorker struct {
 	backend         CeleryBackend
 	numWorkers      int
 	registeredTasks map[string]interface{}
+	taskParams      map[string][]string
+	middlewares     []TaskMiddleware
 	taskLock        sync.RWMutex
 	stopChannel     chan struct{}
 	workWG          sync.WaitGroup
+	options         workerOptions
+	// scheduled are received tasks waiting for their ETA, due receives them when it comes
+	scheduledLock sync.Mutex
+	scheduled     map[*CeleryTask]*time.Timer
+	due           chan *CeleryTask
+	stopped       chan struct{}
+}
+
+// WorkerOptions configures CeleryWorker
+type WorkerOptions struct {
+	f func(*workerOptions)
+}
+
+type workerOptions struct {
+	FailFast      bool
+	AcceptContent []string
+	Client        *CeleryClient
+	AcksOnFailure bool
+}
+
+// WorkerFailFast makes panics in tasks crash the worker process instead of being
+// recorded as FAILURE, which is useful during development
+func WorkerFailFast(failFast bool) WorkerOptions {
+	return WorkerOptions{func(options *workerOptions) {
+		options.FailFast = failFast
+	}}
+}
+
+// WorkerAcceptContent sets names or content types of serializers accepted by the worker,
+// like accept_content setting of Celery. Tasks with other content are dropped.
+// All registered serializers are accepted by default.
+func WorkerAcceptContent(serializers ...string) WorkerOptions {
+	return WorkerOptions{func(options *workerOptions) {
+		options.AcceptContent = serializers
+	}}
+}
+
+// WorkerClient sets client used by running tasks to send subtasks, see TaskContext.Client
+// By default it is a client of the worker broker and backend.
+func WorkerClient(client *CeleryClient) WorkerOptions {
+	return WorkerOptions{func(options *workerOptions) {
+		options.Client = client
+	}}
+}
+
+// WorkerAcksOnFailure sets whether messages of failed tasks are acknowledged or rejected,
+// like task_acks_on_failure_or_timeout setting of Celery. It applies to tasks of brokers
+// acknowledging them late, rejected messages are dropped or dead-lettered. Default is true.
+func WorkerAcksOnFailure(ack bool) WorkerOptions {
+	return WorkerOptions{func(options *workerOptions) {
+		options.AcksOnFailure = ack
+	}}
 }
 
 // NewCeleryWorker returns new celery worker
-func NewCeleryWorker(broker CeleryBroker, backend CeleryBackend, numWorkers int) *CeleryWorker {
+func NewCeleryWorker(broker CeleryBroker, backend CeleryBackend, numWorkers int, options ...WorkerOptions) *CeleryWorker {
+	do := workerOptions{AcksOnFailure: true}
+	for _, opt := range options {
+		opt.f(&do)
+	}
+	if do.Client == nil {
+		do.Client, _ = NewCeleryClient(broker, backend)
+	}
 	return &CeleryWorker{
 		broker:          broker,
 		backend:         backend,
 		numWorkers:      numWorkers,
 		registeredTasks: make(map[string]interface{}),
+		taskParams:      make(map[string][]string),
+		options:         do,
+		scheduled:       make(map[*CeleryTask]*time.Timer),
+		due:             make(chan *CeleryTask),
+		stopped:         make(chan struct{}),
 	}
 }
 
+// PanicError is the error recorded as FAILURE when a task panics
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// RejectError is returned by task to reject its message like Celery Reject, the message is
+// requeued or dropped, i.e. dead-lettered, and no result is stored. It applies to tasks of
+// brokers acknowledging them late, other tasks fail with it.
+type RejectError struct {
+	Cause   error
+	Requeue bool
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("Reject(requeue=%t): %v", e.Requeue, e.Cause)
+}
+
 // StartWorker starts celery worker
 func (w *CeleryWorker) StartWorker() {
 	w.stopChannel = make(chan struct{}, 1)
+	w.scheduledLock.Lock()
+	w.stopped = make(chan struct{})
+	w.scheduledLock.Unlock()
+	if broker, ok := w.broker.(PrefetchingBroker); ok {
+		if err := broker.SetConcurrency(w.numWorkers); err != nil {
+			log.Printf("failed to set concurrency of broker: %v", err)
+		}
+	}
 	w.workWG.Add(w.numWorkers)
 
 	for i := 0; i < w.numWorkers; i++ {
@@ -40,39 +137,204 @@ func (w *CeleryWorker) StartWorker() {
 				select {
 				case <-w.stopChannel:
 					return
+				case task := <-w.due:
+					w.processScheduled(workerID, task)
 				default:
-					// process messages
-					taskMessage, err := w.broker.GetTask()
-					if err != nil || taskMessage == nil {
-						continue
-					}
-
-					log.Printf("WORKER %d task message received: %v\n", workerID, taskMessage)
-					// run task
-					resultMsg, err := w.RunTask(taskMessage)
-					if err != nil {
-						log.Printf("run error: %v", err)
-						continue
-					}
-					defer releaseResultMessage(resultMsg)
-					// push result to backend
-					err = w.backend.SetResult(taskMessage.Id, resultMsg)
-					if err != nil {
-						log.Printf("set result error: %v", err)
-						continue
-					}
+					w.processTask(workerID)
 				}
 			}
 		}(i)
 	}
 }
 
+// processTask gets task message from broker, runs it and pushes its result to backend
+// Tasks with ETA in the future are scheduled to be run then.
+func (w *CeleryWorker) processTask(workerID int) {
+	defer w.recoverWorker(workerID)
+	// process messages
+	taskMessage, err := w.broker.GetTask()
+	if err != nil || taskMessage == nil {
+		return
+	}
+
+	if !w.acceptsContent(taskMessage.Serializer) {
+		log.Printf("WORKER %d refused task %s with content type %s", workerID, taskMessage.Id, taskMessage.Serializer)
+		w.reject(taskMessage, false)
+		return
+	}
+	if w.schedule(taskMessage) {
+		return
+	}
+	w.handleTask(workerID, taskMessage)
+}
+
+// processScheduled runs task whose ETA has come
+func (w *CeleryWorker) processScheduled(workerID int, taskMessage *CeleryTask) {
+	defer w.recoverWorker(workerID)
+	w.handleTask(workerID, taskMessage)
+}
+
+// recoverWorker keeps worker goroutine alive whatever happens, unless the worker fails fast
+func (w *CeleryWorker) recoverWorker(workerID int) {
+	if w.options.FailFast {
+		return
+	}
+	if r := recover(); r != nil {
+		log.Printf("WORKER %d recovered from panic: %v\n%s", workerID, r, debug.Stack())
+	}
+}
+
+// handleTask runs received task, pushes its result to backend and acknowledges it
+func (w *CeleryWorker) handleTask(workerID int, taskMessage *CeleryTask) {
+	log.Printf("WORKER %d task message received: %v\n", workerID, taskMessage)
+	// run task
+	resultMsg, err := w.RunTask(taskMessage)
+	if err != nil {
+		log.Printf("run error: %v", err)
+		resultMsg = getFailureResultMessage(err, nil)
+	}
+	defer releaseResultMessage(resultMsg)
+	if reject, ok := resultMsg.err.(*RejectError); ok && taskMessage.Acknowledger != nil {
+		log.Printf("WORKER %d rejected task %s: %v", workerID, taskMessage.Id, reject)
+		w.reject(taskMessage, reject.Requeue)
+		return
+	}
+	// push result to backend
+	err = setTaskResult(w.backend, taskMessage, resultMsg)
+	if err != nil {
+		log.Printf("set result error: %v", err)
+	}
+	if resultMsg.Status == StateFailure && !w.options.AcksOnFailure {
+		w.reject(taskMessage, false)
+	} else {
+		w.ack(taskMessage)
+	}
+}
+
+// schedule holds task until its ETA, when it is passed to worker goroutines through due
+// Tasks of brokers acknowledging them late stay unacknowledged meanwhile, other tasks are
+// sent again if the worker is stopped before.
+func (w *CeleryWorker) schedule(task *CeleryTask) bool {
+	delay := time.Until(task.ETA)
+	if task.ETA.IsZero() || delay <= 0 {
+		return false
+	}
+	log.Printf("task %s[%s] scheduled at %v", task.Task, task.Id, task.ETA)
+	// held before its timer may release it
+	w.hold(task, 1)
+	w.scheduledLock.Lock()
+	defer w.scheduledLock.Unlock()
+	w.scheduled[task] = time.AfterFunc(delay, func() {
+		w.scheduledLock.Lock()
+		_, ok := w.scheduled[task]
+		delete(w.scheduled, task)
+		stopped := w.stopped
+		w.scheduledLock.Unlock()
+		if !ok {
+			// requeued by stopScheduled
+			return
+		}
+		w.hold(task, -1)
+		select {
+		case w.due <- task:
+		case <-stopped:
+			w.requeue(task)
+		}
+	})
+	return true
+}
+
+// stopScheduled returns scheduled tasks to broker
+func (w *CeleryWorker) stopScheduled() {
+	w.scheduledLock.Lock()
+	close(w.stopped)
+	scheduled := w.scheduled
+	w.scheduled = make(map[*CeleryTask]*time.Timer)
+	w.scheduledLock.Unlock()
+	for task, timer := range scheduled {
+		timer.Stop()
+		w.requeue(task)
+		w.hold(task, -1)
+	}
+}
+
+// hold counts scheduled task acknowledged late in prefetch window of broker while it is held,
+// as its message stays unacknowledged until it is run
+func (w *CeleryWorker) hold(task *CeleryTask, delta int) {
+	broker, ok := w.broker.(PrefetchingBroker)
+	if !ok || task.Acknowledger == nil {
+		return
+	}
+	if err := broker.HoldTasks(delta); err != nil {
+		log.Printf("failed to update prefetch window for task %s: %v", task.Id, err)
+	}
+}
+
+// requeue returns scheduled task to broker, rejecting it if it is acknowledged late
+// or sending it again otherwise
+func (w *CeleryWorker) requeue(task *CeleryTask) {
+	if task.Acknowledger != nil {
+		w.reject(task, true)
+		return
+	}
+	message := task2Headers(task)
+	defer releaseCeleryMessage(message)
+	if task.DeliveryInfo != nil {
+		message.Properties.DeliveryInfo = *task.DeliveryInfo
+	}
+	err := encodeMessageBody(task, message)
+	if err == nil {
+		err = w.broker.SendCeleryMessage(message)
+	}
+	if err != nil {
+		log.Printf("failed to requeue task %s[%s]: %v", task.Task, task.Id, err)
+	}
+}
+
+// ack acknowledges message of task received from broker acknowledging tasks late
+func (w *CeleryWorker) ack(task *CeleryTask) {
+	if task.Acknowledger == nil {
+		return
+	}
+	if err := task.Acknowledger.Ack(); err != nil {
+		log.Printf("failed to acknowledge task %s: %v", task.Id, err)
+	}
+}
+
+// reject rejects message of task received from broker acknowledging tasks late
+func (w *CeleryWorker) reject(task *CeleryTask, requeue bool) {
+	if task.Acknowledger == nil {
+		return
+	}
+	if err := task.Acknowledger.Reject(requeue); err != nil {
+		log.Printf("failed to reject task %s: %v", task.Id, err)
+	}
+}
+
+// acceptsContent checks whether serializer of task body is accepted by the worker
+func (w *CeleryWorker) acceptsContent(serializer string) bool {
+	if len(w.options.AcceptContent) == 0 {
+		return true
+	}
+	received, err := GetSerializer(serializer)
+	if err != nil {
+		return false
+	}
+	for _, name := range w.options.AcceptContent {
+		if accepted, err := GetSerializer(name); err == nil && accepted.ContentType() == received.ContentType() {
+			return true
+		}
+	}
+	return false
+}
+
 // StopWorker stops celery workers
 func (w *CeleryWorker) StopWorker() {
 	for i := 0; i < w.numWorkers; i++ {
 		w.stopChannel <- struct{}{}
 	}
 	w.workWG.Wait()
+	w.stopScheduled()
 }
 
 // GetNumWorkers returns number of currently running workers
@@ -84,9 +346,38 @@ func (w *CeleryWorker) GetNumWorkers() int {
 func (w *CeleryWorker) Register(name string, task interface{}) {
 	w.taskLock.Lock()
 	w.registeredTasks[name] = task
+	delete(w.taskParams, name)
 	w.taskLock.Unlock()
 }
 
+// RegisterWithParams registers function task with names of its parameters,
+// so that kwargs can be bound to them like Python keyword arguments
+// Names must be given for all parameters except the variadic one and TaskContext
+func (w *CeleryWorker) RegisterWithParams(name string, task interface{}, params ...string) error {
+	funcType := reflect.TypeOf(task)
+	if funcType == nil || funcType.Kind() != reflect.Func {
+		return fmt.Errorf("task %s is not a function", name)
+	}
+	numParams := argsFuncType(funcType).NumIn()
+	if funcType.IsVariadic() {
+		numParams--
+	}
+	if len(params) != numParams {
+		return fmt.Errorf("task %s has %d parameters but %d names were given", name, numParams, len(params))
+	}
+	w.taskLock.Lock()
+	w.registeredTasks[name] = task
+	w.taskParams[name] = params
+	w.taskLock.Unlock()
+	return nil
+}
+
+// Use adds task middlewares, they are called in the order they were added
+// Middlewares must be added before the worker is started
+func (w *CeleryWorker) Use(middlewares ...TaskMiddleware) {
+	w.middlewares = append(w.middlewares, middlewares...)
+}
+
 // GetTask retrieves registered task
 func (w *CeleryWorker) GetTask(name string) interface{} {
 	w.taskLock.RLock()
@@ -99,8 +390,38 @@ func (w *CeleryWorker) GetTask(name string) interface{} {
 	return task
 }
 
-// RunTask runs celery task
-func (w *CeleryWorker) RunTask(message *CeleryTask) (*ResultMessage, error) {
+// getTaskParams retrieves parameter names of registered task
+func (w *CeleryWorker) getTaskParams(name string) []string {
+	w.taskLock.RLock()
+	defer w.taskLock.RUnlock()
+	return w.taskParams[name]
+}
+
+// RunTask runs celery task through worker middlewares
+// A panic in the task is recovered and returned as FAILURE with its stack trace as traceback,
+// unless the worker fails fast.
+func (w *CeleryWorker) RunTask(message *CeleryTask) (result *ResultMessage, err error) {
+	if !w.options.FailFast {
+		defer func() {
+			if r := recover(); r != nil {
+				traceback := fmt.Sprintf("panic: %v\n\n%s", r, debug.Stack())
+				log.Printf("task %s[%s] panicked: %s", message.Task, message.Id, traceback)
+				result, err = getFailureResultMessage(&PanicError{r}, traceback), nil
+			}
+		}()
+	}
+	taskContext := newTaskContext(message, w.options.Client, w.backend)
+	defer taskContext.cancel()
+	message.context = taskContext
+	result, err = chainTaskMiddlewares(w.middlewares, w.runTask)(message)
+	if err == nil && result != nil {
+		result.Children = append(result.Children, taskContext.resultChildren()...)
+	}
+	return result, err
+}
+
+// runTask runs celery task
+func (w *CeleryWorker) runTask(message *CeleryTask) (*ResultMessage, error) {
 
 	// get task
 	task := w.GetTask(message.Task)
@@ -108,52 +429,170 @@ func (w *CeleryWorker) RunTask(message *CeleryTask) (*ResultMessage, error) {
 		return nil, fmt.Errorf("task %s is not registered", message.Task)
 	}
 
+	// typed tasks decode arguments themselves
+	if runner, ok := task.(taskRunner); ok {
+		return runner.run(message)
+	}
+
 	// convert to task interface
 	taskInterface, ok := task.(Itf_CeleryTask)
 	if ok {
 		if err := taskInterface.ParseKwargs(message.Kwargs); err != nil {
 			return nil, err
 		}
-		val, err := taskInterface.RunTask()
+		var val interface{}
+		var err error
+		if contextual, ok := task.(ContextualTask); ok {
+			val, err = contextual.RunTaskWithContext(message.context)
+		} else {
+			val, err = taskInterface.RunTask()
+		}
 		if err != nil {
-			return nil, err
+			return getFailureResultMessage(err, nil), nil
 		}
-		return getResultMessage(val), err
+		return getResultMessage(val), nil
 	}
 	// log.Println("using reflection")
 
 	// use reflection to execute function ptr
 	taskFunc := reflect.ValueOf(task)
-	return runTaskFunc(&taskFunc, message)
+	return runTaskFunc(&taskFunc, message, w.getTaskParams(message.Task))
+}
+
+func runTaskFunc(taskFunc *reflect.Value, message *CeleryTask, params []string) (*ResultMessage, error) {
+	funcType := taskFunc.Type()
+	argsType := argsFuncType(funcType)
+	in, err := bindTaskArgs(argsType, message.Args, message.Kwargs, params)
+	if err != nil {
+		return nil, fmt.Errorf("task %s: %v", message.Task, err)
+	}
+	if argsType != funcType {
+		// message context is set by RunTask
+		in = append([]reflect.Value{reflect.ValueOf(message.context)}, in...)
+	}
+
+	// call method
+	res := taskFunc.Call(in)
+	return getFuncResultMessage(res), nil
 }
 
-func runTaskFunc(taskFunc *reflect.Value, message *CeleryTask) (*ResultMessage, error) {
+// getFuncResultMessage builds result from return values of task function
+// A trailing error return value is not stored, FAILURE is returned if it is not nil,
+// and multiple other return values are stored as a list like Python tuples.
+func getFuncResultMessage(res []reflect.Value) *ResultMessage {
+	if n := len(res); n > 0 && res[n-1].Type() == errorType {
+		if !res[n-1].IsNil() {
+			return getFailureResultMessage(res[n-1].Interface().(error), nil)
+		}
+		res = res[:n-1]
+	}
+	switch len(res) {
+	case 0:
+		return getResultMessage(nil)
+	case 1:
+		return getReflectionResultMessage(&res[0])
+	}
+	values := make([]interface{}, len(res))
+	for i := range res {
+		values[i] = GetRealValue(&res[i])
+	}
+	return getResultMessage(values)
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// argsFuncType returns type of function funcType without its leading TaskContext parameter,
+// whose parameters are bound to task arguments
+func argsFuncType(funcType reflect.Type) reflect.Type {
+	if funcType.NumIn() == 0 || funcType.In(0) != taskContextType {
+		return funcType
+	}
+	in := make([]reflect.Type, funcType.NumIn()-1)
+	for i := range in {
+		in[i] = funcType.In(i + 1)
+	}
+	out := make([]reflect.Type, funcType.NumOut())
+	for i := range out {
+		out[i] = funcType.Out(i)
+	}
+	return reflect.FuncOf(in, out, funcType.IsVariadic())
+}
+
+// bindTaskArgs converts message args and kwargs into parameters of function type funcType
+// Positional args fill leading parameters, kwargs fill the remaining ones either by
+// parameter names given at registration, or as fields of a trailing struct parameter.
+func bindTaskArgs(funcType reflect.Type, args []interface{}, kwargs map[string]interface{}, params []string) ([]reflect.Value, error) {
+	if len(kwargs) == 0 {
+		return convertTaskArgs(funcType, args)
+	}
+	numParams := funcType.NumIn()
+	if funcType.IsVariadic() {
+		numParams--
+	}
+	merged := make([]interface{}, len(args), len(args)+len(kwargs))
+	copy(merged, args)
+	if params == nil {
+		// bind kwargs to trailing struct parameter
+		if funcType.IsVariadic() || len(args) != numParams-1 || !isKwargsType(funcType.In(numParams-1)) {
+			return nil, fmt.Errorf("task does not accept keyword arguments %v", kwargs)
+		}
+		return convertTaskArgs(funcType, append(merged, kwargs))
+	}
+	for i := len(args); i < numParams; i++ {
+		arg, ok := kwargs[params[i]]
+		if !ok {
+			return nil, fmt.Errorf("missing argument %s", params[i])
+		}
+		merged = append(merged, arg)
+	}
+	for k := range kwargs {
+		i := indexOf(params, k)
+		if i < 0 {
+			return nil, fmt.Errorf("unexpected keyword argument %s", k)
+		}
+		if i < len(args) {
+			return nil, fmt.Errorf("got multiple values for argument %s", k)
+		}
+	}
+	return convertTaskArgs(funcType, merged)
+}
+
+// indexOf returns index of s in list or -1 if absent
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
 
+// convertTaskArgs converts message arguments into parameters of function type funcType
+func convertTaskArgs(funcType reflect.Type, args []interface{}) ([]reflect.Value, error) {
 	// check number of arguments
-	numArgs := taskFunc.Type().NumIn()
-	messageNumArgs := len(message.Args)
-	if numArgs != messageNumArgs {
+	numArgs := funcType.NumIn()
+	messageNumArgs := len(args)
+	if funcType.IsVariadic() {
+		if messageNumArgs < numArgs-1 {
+			return nil, fmt.Errorf("Number of task arguments %d does not match number of message arguments %d", numArgs-1, messageNumArgs)
+		}
+	} else if numArgs != messageNumArgs {
 		return nil, fmt.Errorf("Number of task arguments %d does not match number of message arguments %d", numArgs, messageNumArgs)
 	}
 	// construct arguments
 	in := make([]reflect.Value, messageNumArgs)
-	for i, arg := range message.Args {
-		origType := taskFunc.Type().In(i).Kind()
-		msgType := reflect.TypeOf(arg).Kind()
-		// special case - convert float64 to int if applicable
-		// this is due to json limitation where all numbers are converted to float64
-		if origType == reflect.Int && msgType == reflect.Float64 {
-			arg = int(arg.(float64))
+	for i, arg := range args {
+		var argType reflect.Type
+		if funcType.IsVariadic() && i >= numArgs-1 {
+			argType = funcType.In(numArgs - 1).Elem()
+		} else {
+			argType = funcType.In(i)
 		}
-
-		in[i] = reflect.ValueOf(arg)
-	}
-
-	// call method
-	res := taskFunc.Call(in)
-	if len(res) == 0 {
-		return nil, nil
+		val, err := ConvertArg(arg, argType)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %v", i, err)
+		}
+		in[i] = val
 	}
-	// defer releaseResultMessage(resultMessage)
-	return getReflectionResultMessage(&res[0]), nil
+	return in, nil
 }
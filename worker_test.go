@@ -1,7 +1,11 @@
 package gocelery
 
 import (
+    "fmt"
     "math/rand"
+    "reflect"
+    "strings"
+    "sync"
     "testing"
     "time"
 )
@@ -71,6 +75,174 @@ func TestRunTask(t *testing.T) {
     }
 }
 
+type greetOptions struct {
+    Greeting string `json:"greeting"`
+    Times    int    `json:"times"`
+}
+
+func greet(name string, options greetOptions) string {
+    return strings.Repeat(options.Greeting+" "+name+"! ", options.Times)
+}
+
+func TestRunTaskKwargsStruct(t *testing.T) {
+    celeryWorker := newCeleryWorker(1)
+    celeryWorker.Register("greet", greet)
+    resultMsg, err := celeryWorker.RunTask(&CeleryTask{
+        Id:     generateUUID(),
+        Task:   "greet",
+        Args:   []interface{}{"gopher"},
+        Kwargs: map[string]interface{}{"greeting": "hello", "times": float64(2)},
+    })
+    if err != nil {
+        t.Fatalf("failed to run celery task: %v", err)
+    }
+    if resultMsg.Result != "hello gopher! hello gopher! " {
+        t.Errorf("unexpected result %v", resultMsg.Result)
+    }
+}
+
+func TestRunTaskKwargsNamed(t *testing.T) {
+    celeryWorker := newCeleryWorker(1)
+    if err := celeryWorker.RegisterWithParams("add", add, "x"); err == nil {
+        t.Errorf("wrong number of parameter names was accepted")
+    }
+    if err := celeryWorker.RegisterWithParams("add", add, "x", "y"); err != nil {
+        t.Fatalf("failed to register task: %v", err)
+    }
+    cases := []struct {
+        args   []interface{}
+        kwargs map[string]interface{}
+        ok     bool
+    }{
+        {nil, map[string]interface{}{"x": float64(2), "y": float64(3)}, true},
+        {[]interface{}{float64(2)}, map[string]interface{}{"y": float64(3)}, true},
+        {[]interface{}{float64(2), float64(3)}, nil, true},
+        {[]interface{}{float64(2)}, map[string]interface{}{"x": float64(3)}, false},
+        {nil, map[string]interface{}{"x": float64(2)}, false},
+        {nil, map[string]interface{}{"x": float64(2), "y": float64(3), "z": float64(4)}, false},
+    }
+    for _, c := range cases {
+        resultMsg, err := celeryWorker.RunTask(&CeleryTask{
+            Id:     generateUUID(),
+            Task:   "add",
+            Args:   c.args,
+            Kwargs: c.kwargs,
+        })
+        if !c.ok {
+            if err == nil {
+                t.Errorf("invalid arguments %v %v were accepted", c.args, c.kwargs)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("failed to run task with %v %v: %v", c.args, c.kwargs, err)
+            continue
+        }
+        if resultMsg.Result != int64(5) {
+            t.Errorf("unexpected result %v", resultMsg.Result)
+        }
+    }
+}
+
+type point struct {
+    X int `json:"x"`
+    Y int `json:"y"`
+}
+
+func TestRunTaskReturnValues(t *testing.T) {
+    celeryWorker := newCeleryWorker(1)
+    celeryWorker.Register("points", func(n int) ([]point, error) {
+        if n < 0 {
+            return nil, fmt.Errorf("negative count %d", n)
+        }
+        points := make([]point, n)
+        for i := range points {
+            points[i] = point{i, i * i}
+        }
+        return points, nil
+    })
+    celeryWorker.Register("check", func(n int) error {
+        if n < 0 {
+            return fmt.Errorf("negative count %d", n)
+        }
+        return nil
+    })
+    celeryWorker.Register("divmod", func(a, b int) (int, int) {
+        return a / b, a % b
+    })
+    cases := []struct {
+        task     string
+        args     []interface{}
+        status   string
+        expected interface{}
+    }{
+        {"points", []interface{}{2}, StateSuccess, []point{{0, 0}, {1, 1}}},
+        {"points", []interface{}{-1}, StateFailure, nil},
+        {"check", []interface{}{1}, StateSuccess, nil},
+        {"check", []interface{}{-1}, StateFailure, nil},
+        {"divmod", []interface{}{7, 2}, StateSuccess, []interface{}{int64(3), int64(1)}},
+    }
+    for _, c := range cases {
+        resultMsg, err := celeryWorker.RunTask(&CeleryTask{
+            Id:   generateUUID(),
+            Task: c.task,
+            Args: c.args,
+        })
+        if err != nil {
+            t.Errorf("failed to run %s%v: %v", c.task, c.args, err)
+            continue
+        }
+        if resultMsg.Status != c.status {
+            t.Errorf("%s%v returned status %s, expected %s", c.task, c.args, resultMsg.Status, c.status)
+            continue
+        }
+        if c.status == StateFailure {
+            exc := resultMsg.Result.(map[string]interface{})
+            if !reflect.DeepEqual(exc["exc_message"], []interface{}{"negative count -1"}) {
+                t.Errorf("unexpected failure result %v", exc)
+            }
+            continue
+        }
+        if !reflect.DeepEqual(resultMsg.Result, c.expected) {
+            t.Errorf("%s%v returned %#v, expected %#v", c.task, c.args, resultMsg.Result, c.expected)
+        }
+    }
+}
+
+func TestRunTaskPanic(t *testing.T) {
+    celeryWorker := newCeleryWorker(1)
+    celeryWorker.Register("explode", func(values []int) int {
+        return values[3]
+    })
+    task := &CeleryTask{
+        Id:   generateUUID(),
+        Task: "explode",
+        Args: []interface{}{[]interface{}{1}},
+    }
+    resultMsg, err := celeryWorker.RunTask(task)
+    if err != nil {
+        t.Fatalf("failed to run celery task: %v", err)
+    }
+    if resultMsg.Status != StateFailure {
+        t.Fatalf("panic was not recorded as failure: %v", resultMsg)
+    }
+    traceback, _ := resultMsg.Traceback.(string)
+    if !strings.Contains(traceback, "index out of range") || !strings.Contains(traceback, "goroutine") {
+        t.Errorf("traceback does not contain panic and stack: %v", traceback)
+    }
+
+    celeryWorker = NewCeleryWorker(nil, nil, 1, WorkerFailFast(true))
+    celeryWorker.Register("explode", func(values []int) int {
+        return values[3]
+    })
+    defer func() {
+        if r := recover(); r == nil {
+            t.Errorf("fail fast worker did not panic")
+        }
+    }()
+    celeryWorker.RunTask(task)
+}
+
 func TestNumWorkers(t *testing.T) {
     numWorkers := rand.Intn(10)
     celeryWorker := newCeleryWorker(numWorkers)
@@ -88,3 +260,232 @@ func TestStartStop(t *testing.T) {
     time.Sleep(100 * time.Millisecond)
     celeryWorker.StopWorker()
 }
+
+// ackRecorder records acknowledgement of a task
+type ackRecorder struct {
+    acks *[]string
+}
+
+func (a ackRecorder) Ack() error {
+    *a.acks = append(*a.acks, "ack")
+    return nil
+}
+
+func (a ackRecorder) Reject(requeue bool) error {
+    if requeue {
+        *a.acks = append(*a.acks, "requeue")
+    } else {
+        *a.acks = append(*a.acks, "reject")
+    }
+    return nil
+}
+
+// lateAckBroker is memoryBroker acknowledging tasks late
+type lateAckBroker struct {
+    memoryBroker
+    acks []string
+}
+
+func (b *lateAckBroker) GetTask() (*CeleryTask, error) {
+    task, err := b.memoryBroker.GetTask()
+    if task != nil {
+        task.Acknowledger = ackRecorder{&b.acks}
+    }
+    return task, err
+}
+
+func TestAcksLate(t *testing.T) {
+    tests := []struct {
+        name     string
+        task     interface{}
+        options  []WorkerOptions
+        expected string
+        stored   bool
+    }{
+        {"success", func() int { return 1 }, nil, "ack", true},
+        {"failure", func() error { return fmt.Errorf("failed") }, nil, "ack", true},
+        {"dead letter", func() error { return fmt.Errorf("failed") }, []WorkerOptions{WorkerAcksOnFailure(false)}, "reject", true},
+        {"requeue", func() error { return &RejectError{fmt.Errorf("busy"), true} }, nil, "requeue", false},
+        {"unregistered", nil, []WorkerOptions{WorkerAcksOnFailure(false)}, "reject", true},
+    }
+    for _, test := range tests {
+        broker, backend := &lateAckBroker{}, newMemoryBackend()
+        client, _ := NewCeleryClient(broker, backend)
+        celeryWorker := NewCeleryWorker(broker, backend, 1, test.options...)
+        if test.task != nil {
+            celeryWorker.Register("task", test.task)
+        }
+        asyncResult, _ := client.Delay("task")
+        celeryWorker.processTask(0)
+        if len(broker.acks) != 1 || broker.acks[0] != test.expected {
+            t.Errorf("%s: message acknowledged with %v instead of %s", test.name, broker.acks, test.expected)
+        }
+        if ready, _ := asyncResult.Ready(); ready != test.stored {
+            t.Errorf("%s: result stored %t", test.name, ready)
+        }
+    }
+}
+
+// prefetchingBroker is empty broker recording concurrency set by worker
+type prefetchingBroker struct {
+    concurrency int
+}
+
+func (b *prefetchingBroker) SendCeleryMessage(message *CeleryMessage) error {
+    return nil
+}
+
+func (b *prefetchingBroker) GetTask() (*CeleryTask, error) {
+    return nil, fmt.Errorf("no message available")
+}
+
+func (b *prefetchingBroker) SetConcurrency(concurrency int) error {
+    b.concurrency = concurrency
+    return nil
+}
+
+func (b *prefetchingBroker) HoldTasks(delta int) error {
+    return nil
+}
+
+// windowBroker is broker acknowledging tasks late, which stops delivering them once
+// unacknowledged tasks fill its prefetch window like AMQP broker
+type windowBroker struct {
+    lock     sync.Mutex
+    messages []*CeleryMessage
+    window   int
+    held     int
+    unacked  int
+}
+
+func (b *windowBroker) SendCeleryMessage(message *CeleryMessage) error {
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    copied := *message
+    b.messages = append(b.messages, &copied)
+    return nil
+}
+
+func (b *windowBroker) GetTask() (*CeleryTask, error) {
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    if len(b.messages) == 0 || b.unacked >= b.window+b.held {
+        return nil, fmt.Errorf("no message available")
+    }
+    task := Msg2Task(b.messages[0])
+    b.messages = b.messages[1:]
+    b.unacked++
+    task.Acknowledger = windowAck{b}
+    return task, nil
+}
+
+func (b *windowBroker) SetConcurrency(concurrency int) error {
+    b.lock.Lock()
+    b.window = concurrency
+    b.lock.Unlock()
+    return nil
+}
+
+func (b *windowBroker) HoldTasks(delta int) error {
+    b.lock.Lock()
+    b.held += delta
+    b.lock.Unlock()
+    return nil
+}
+
+// windowAck frees place of acknowledged task in prefetch window of windowBroker
+type windowAck struct {
+    broker *windowBroker
+}
+
+func (a windowAck) Ack() error {
+    a.broker.lock.Lock()
+    a.broker.unacked--
+    a.broker.lock.Unlock()
+    return nil
+}
+
+func (a windowAck) Reject(requeue bool) error {
+    return a.Ack()
+}
+
+func TestWorkerConcurrency(t *testing.T) {
+    broker := &prefetchingBroker{}
+    celeryWorker := NewCeleryWorker(broker, newMemoryBackend(), 3)
+    celeryWorker.StartWorker()
+    celeryWorker.StopWorker()
+    if broker.concurrency != 3 {
+        t.Errorf("broker concurrency set to %d instead of 3", broker.concurrency)
+    }
+}
+
+func TestWorkerETA(t *testing.T) {
+    broker, backend := &memoryBroker{}, newMemoryBackend()
+    client, _ := NewCeleryClient(broker, backend)
+    celeryWorker := NewCeleryWorker(broker, backend, 1)
+    runs := make(chan time.Time, 2)
+    celeryWorker.Register("flaky", func(ctx *TaskContext) error {
+        runs <- time.Now()
+        return ctx.Retry(fmt.Errorf("unavailable"), 300*time.Millisecond, 1)
+    })
+    client.Delay("flaky")
+    celeryWorker.StartWorker()
+    defer celeryWorker.StopWorker()
+    first := <-runs
+    select {
+    case second := <-runs:
+        if delay := second.Sub(first); delay < 300*time.Millisecond {
+            t.Errorf("task retried after %v instead of its countdown", delay)
+        }
+    case <-time.After(5 * time.Second):
+        t.Errorf("task was not retried")
+    }
+}
+
+func TestWorkerETAPrefetch(t *testing.T) {
+    broker, backend := &windowBroker{}, newMemoryBackend()
+    client, _ := NewCeleryClient(broker, backend)
+    celeryWorker := NewCeleryWorker(broker, backend, 1)
+    celeryWorker.Register("add", add)
+    // more tasks held until their ETA than fit in prefetch window
+    eta := time.Now().Add(time.Hour)
+    for i := 0; i < 3; i++ {
+        client.ApplyAsync("add", []interface{}{1, 2}, nil, nil, &eta, false, "", 0, "", "")
+    }
+    asyncResult, _ := client.Delay("add", 1, 2)
+    celeryWorker.StartWorker()
+    res, err := asyncResult.Get(5 * time.Second)
+    celeryWorker.StopWorker()
+    if err != nil || res != float64(3) {
+        t.Errorf("task was not run while tasks were held: %v %v", res, err)
+    }
+    broker.lock.Lock()
+    defer broker.lock.Unlock()
+    if broker.held != 0 || broker.unacked != 0 {
+        t.Errorf("%d tasks still held and %d unacknowledged", broker.held, broker.unacked)
+    }
+}
+
+func TestWorkerETARequeue(t *testing.T) {
+    broker, backend := &memoryBroker{}, newMemoryBackend()
+    client, _ := NewCeleryClient(broker, backend)
+    celeryWorker := NewCeleryWorker(broker, backend, 1)
+    celeryWorker.Register("later", func() int { return 1 })
+    eta := time.Now().Add(time.Hour)
+    asyncResult, _ := client.ApplyAsync("later", []interface{}{"a"}, nil, nil, &eta, false, "", 0, "", "")
+    celeryWorker.processTask(0)
+    if len(broker.messages) != 0 {
+        t.Fatalf("scheduled task was not received")
+    }
+    if ready, _ := asyncResult.Ready(); ready {
+        t.Errorf("task was run before its ETA")
+    }
+    celeryWorker.stopScheduled()
+    if len(broker.messages) != 1 {
+        t.Fatalf("scheduled task was not requeued")
+    }
+    task := Msg2Task(broker.messages[0])
+    if task.Id != asyncResult.GetTaskId() || task.ETA.Unix() != eta.Unix() || len(task.Args) != 1 {
+        t.Errorf("unexpected requeued task %+v", task)
+    }
+}